@@ -19,6 +19,7 @@ package deployer
 import (
 	"fmt"
 	"os"
+	"time"
 
 	git "github.com/go-git/go-git/v5"
 	plumbing "github.com/go-git/go-git/v5/plumbing"
@@ -42,6 +43,8 @@ type BuildOptions struct {
 	Target     string `flag:"target" desc:"--target flag for custom config component to test, e.g. cloud-provider-azure"`
 	TargetPath string `flag:"targetPath" desc:"--targetPath flag for local repo, not set with TargetCommit or TargetFlag"`
 	TargetTag  string `flag:"targetTag" desc:"--targetTag flag for custom config component's refs"`
+
+	BuildTimeout time.Duration `flag:"buildTimeout" desc:"--buildTimeout flag for how long Build may take, 0 for no limit"`
 }
 
 func (d *deployer) verifyBuildFlags() error {
@@ -58,7 +61,7 @@ func (d *deployer) verifyBuildFlags() error {
 
 func (d *deployer) makeCloudProviderImages(path string) (string, error) {
 	// Show commit
-	if err := runCmd(exec.Command("git", "-C", path, "show", "--stat")); err != nil {
+	if err := runCmd(exec.CommandContext(d.ctx, "git", "-C", path, "show", "--stat")); err != nil {
 		return "", fmt.Errorf("failed to show commit: %v", err)
 	}
 
@@ -68,12 +71,14 @@ func (d *deployer) makeCloudProviderImages(path string) (string, error) {
 		targets = []string{"build-node-image-linux-amd64", "push-node-image-linux-amd64"}
 	}
 	for _, target := range targets {
-		if err := runCmd(exec.Command("make", "-C", path, target)); err != nil {
+		if err := d.step("make "+target, func() error {
+			return runCmd(exec.CommandContext(d.ctx, "make", "-C", path, target))
+		}); err != nil {
 			return "", fmt.Errorf("failed to make %s: %v", target, err)
 		}
 	}
 
-	imageTag, err := exec.Output(exec.Command("git", "-C", path, "rev-parse", "--short=7", "HEAD"))
+	imageTag, err := cmdOutput(exec.CommandContext(d.ctx, "git", "-C", path, "rev-parse", "--short=7", "HEAD"))
 	if err != nil {
 		return "", fmt.Errorf("failed to get image tag: %v", err)
 	}
@@ -94,9 +99,13 @@ func (d *deployer) makeCloudProviderImagesByTag(url string) (string, error) {
 	klog.Infof("Making Cloud provider images with refs")
 	ccmPath := fmt.Sprintf("%s/cloud-provider-azure", gitClonePath)
 
-	repo, err := git.PlainClone(ccmPath, false, &git.CloneOptions{
-		URL:      url,
-		Progress: os.Stdout,
+	var repo *git.Repository
+	err := d.step("clone", func() (err error) {
+		repo, err = git.PlainCloneContext(d.ctx, ccmPath, false, &git.CloneOptions{
+			URL:      url,
+			Progress: os.Stdout,
+		})
+		return err
 	})
 	if err != nil {
 		return "", fmt.Errorf("failed to clone from URL %q", url)
@@ -114,6 +123,14 @@ func (d *deployer) makeCloudProviderImagesByTag(url string) (string, error) {
 }
 
 func (d *deployer) Build() error {
+	d, cancel := d.withPhaseContext("Build", d.BuildTimeout, true)
+	defer cancel()
+	err := d.phaseError(d.build(), d.BuildTimeout)
+	d.writePhaseResults(err)
+	return err
+}
+
+func (d *deployer) build() error {
 	err := d.verifyBuildFlags()
 	if err != nil {
 		return fmt.Errorf("failed to verify build flags: %v", err)
@@ -0,0 +1,280 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog"
+)
+
+var (
+	// runIDTag tags the cluster with the run which created it. The cloud provider tags
+	// the resources it creates with it through the tags of its cloud config.
+	runIDTag = "kubetest2-aks-run-id"
+
+	// ccmComponent is the cloud controller manager in the custom configuration.
+	ccmComponent = "kube-cloud-controller-manager"
+	// defaultCCMClusterName is the --cluster-name of the cloud controller manager the
+	// cloud provider tags its resources with when the custom configuration has none.
+	defaultCCMClusterName = "kubernetes"
+
+	// ccmResourceDeleteOrder deletes the resources referencing others first: private link
+	// services use frontends of load balancers, which use public IPs.
+	ccmResourceDeleteOrder = map[string]int{
+		"microsoft.network/privatelinkservices": 0,
+		"microsoft.network/loadbalancers":       1,
+	}
+)
+
+// taggedResource is a resource the cloud provider tagged with the run ID.
+type taggedResource struct {
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	Tags        map[string]string `json:"tags"`
+	CreatedTime time.Time         `json:"createdTime"`
+}
+
+func (r taggedResource) deleteOrder() int {
+	if order, ok := ccmResourceDeleteOrder[strings.ToLower(r.Type)]; ok {
+		return order
+	}
+	return len(ccmResourceDeleteOrder)
+}
+
+// clusterRunID returns the run ID the cluster is tagged with, the ID of the kubetest2
+// run which first created it, recorded so a resumed or reused cluster keeps it.
+func (d *deployer) clusterRunID() (string, error) {
+	state, err := d.loadState()
+	if err != nil {
+		return "", err
+	}
+	for _, cluster := range state.Clusters {
+		if cluster.ClusterName == d.ClusterName && cluster.RunID != "" {
+			return cluster.RunID, nil
+		}
+	}
+	runID := d.commonOptions.RunID()
+	if err := d.updateClusterState(func(cluster *clusterState) {
+		cluster.RunID = runID
+	}); err != nil {
+		return "", fmt.Errorf("failed to update state: %v", err)
+	}
+	return runID, nil
+}
+
+// ccmConfiguration returns the cloud controller manager of the encoded custom
+// configuration of the cluster config, and the decoded custom configuration.
+func ccmConfiguration(clusterConfig interface{}) (map[string]interface{}, map[string]interface{}, error) {
+	config, ok := clusterConfig.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("cluster config is not a JSON object")
+	}
+	properties, _ := config["properties"].(map[string]interface{})
+	encoded, _ := properties["encodedCustomConfiguration"].(string)
+	if encoded == "" {
+		return nil, nil, fmt.Errorf("cluster config has no custom configuration")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode custom configuration: %v", err)
+	}
+	customConfig := map[string]interface{}{}
+	if err := json.Unmarshal(data, &customConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal custom configuration: %v", err)
+	}
+	components, _ := customConfig["kubernetesConfigurations"].(map[string]interface{})
+	ccm, ok := components[ccmComponent].(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("custom configuration has no %s", ccmComponent)
+	}
+	return ccm, customConfig, nil
+}
+
+// ccmClusterName returns the cluster name the cloud provider tags its resources with,
+// the --cluster-name of the cloud controller manager of the custom configuration.
+func ccmClusterName(clusterConfig interface{}) (string, error) {
+	ccm, _, err := ccmConfiguration(clusterConfig)
+	if err != nil {
+		return "", err
+	}
+	flags, _ := ccm["config"].(map[string]interface{})
+	if name, _ := flags["--cluster-name"].(string); name != "" {
+		return name, nil
+	}
+	return defaultCCMClusterName, nil
+}
+
+// tagRunID tags the cluster config with the run ID, and adds it to the tags of the
+// cloud config of the cloud controller manager, which tags the resources it creates
+// with them. The custom configuration hash is computed before, so a reused cluster
+// matches whatever run created it.
+func tagRunID(clusterConfig interface{}, runID string) error {
+	ccm, customConfig, err := ccmConfiguration(clusterConfig)
+	if err != nil {
+		return err
+	}
+	cloudConfig, ok := ccm["cloudConfig"].(map[string]interface{})
+	if !ok {
+		cloudConfig = map[string]interface{}{}
+		ccm["cloudConfig"] = cloudConfig
+	}
+	// Tags of the cloud config are key=value pairs separated by commas
+	var cloudTags []string
+	if existing, _ := cloudConfig["tags"].(string); existing != "" {
+		for _, tag := range strings.Split(existing, ",") {
+			if !strings.HasPrefix(strings.TrimSpace(tag), runIDTag+"=") {
+				cloudTags = append(cloudTags, tag)
+			}
+		}
+	}
+	cloudConfig["tags"] = strings.Join(append(cloudTags, runIDTag+"="+runID), ",")
+	data, err := json.Marshal(customConfig)
+	if err != nil {
+		return fmt.Errorf("failed to marshal custom configuration: %v", err)
+	}
+
+	config := clusterConfig.(map[string]interface{})
+	config["properties"].(map[string]interface{})["encodedCustomConfiguration"] = base64.StdEncoding.EncodeToString(data)
+	tags, ok := config["tags"].(map[string]interface{})
+	if !ok {
+		tags = map[string]interface{}{}
+		config["tags"] = tags
+	}
+	tags[runIDTag] = runID
+	return nil
+}
+
+// nodeResourceGroups returns the node resource groups of the clusters which exist.
+func (d *deployer) nodeResourceGroups(clusters []*deployer) []string {
+	var resourceGroups []string
+	for _, c := range clusters {
+		nodeResourceGroup, err := c.nodeResourceGroup()
+		if err != nil {
+			klog.Infof("Node resource group of cluster %q is unknown: %v", c.ClusterName, err)
+			continue
+		}
+		resourceGroups = append(resourceGroups, nodeResourceGroup)
+	}
+	return resourceGroups
+}
+
+// taggedClusterResources lists the resources of the subscription tagged with the run
+// ID. The cluster name the cloud provider tags its resources with is "kubernetes" on
+// every AKS cluster, so only the run ID tells the resources of the run.
+func (d *deployer) taggedClusterResources(runID string) ([]taggedResource, error) {
+	filter := fmt.Sprintf("tagName eq '%s' and tagValue eq '%s'", runIDTag, runID)
+	values, err := d.listRawResources(resourcesAPIVersion, fmt.Sprintf("/subscriptions/%s/resources", subscriptionID),
+		autorest.WithQueryParameters(map[string]interface{}{"$filter": filter, "$expand": "createdTime"}))
+	if err != nil {
+		return nil, err
+	}
+	var resources []taggedResource
+	for _, raw := range values {
+		r := taggedResource{}
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return nil, fmt.Errorf("failed to decode resource tagged with run ID %q: %v", runID, err)
+		}
+		resources = append(resources, r)
+	}
+	return resources, nil
+}
+
+// ccmResourcesToDelete returns the resources the cloud provider of the run created,
+// in the order they can be deleted: tagged with the run ID and the cluster name of
+// the cloud provider, created since Up, and of the types the cloud provider creates.
+func ccmResourcesToDelete(resources []taggedResource, ccmClusterName, runID string, upAt time.Time) []taggedResource {
+	var toDelete []taggedResource
+	for _, r := range resources {
+		if r.Tags[runIDTag] != runID {
+			klog.Infof("Not deleting %q of another run", r.ID)
+			continue
+		}
+		if r.Tags[clusterNameTag] != ccmClusterName {
+			klog.Infof("Not deleting %q the cloud provider did not create", r.ID)
+			continue
+		}
+		if r.CreatedTime.IsZero() || r.CreatedTime.Before(upAt) {
+			klog.Infof("Not deleting %q created before Up at %s", r.ID, upAt.Format(time.RFC3339))
+			continue
+		}
+		if !strings.HasPrefix(strings.ToLower(r.Type), "microsoft.network/") {
+			klog.Warningf("Not deleting %q of type %s the cloud provider does not create", r.ID, r.Type)
+			continue
+		}
+		toDelete = append(toDelete, r)
+	}
+	sort.SliceStable(toDelete, func(i, j int) bool {
+		return toDelete[i].deleteOrder() < toDelete[j].deleteOrder()
+	})
+	return toDelete
+}
+
+// deleteCCMResources deletes the resources the cloud provider created for the
+// cluster outside its resource groups, like public IPs and load balancers in the
+// resource groups of Service annotations. Nothing is deleted unless the state
+// recorded when Up created the cluster, the run ID it is tagged with and the
+// cluster name of its cloud provider.
+func (d *deployer) deleteCCMResources(cluster clusterState) error {
+	if cluster.UpAt.IsZero() || cluster.RunID == "" || cluster.CCMClusterName == "" {
+		klog.Warningf("Not deleting resources of the cloud provider of cluster %q: its Up time, run ID and cloud provider cluster name are not in the state file %s", d.ClusterName, d.stateFilePath())
+		return nil
+	}
+
+	resources, err := d.taggedClusterResources(cluster.RunID)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, r := range ccmResourcesToDelete(resources, cluster.CCMClusterName, cluster.RunID, cluster.UpAt) {
+		klog.Infof("Deleting %q created by the cloud provider of cluster %q", r.ID, d.ClusterName)
+		errs = append(errs, d.deleteResource(networkAPIVersion, r.ID))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// verifyNodeResourceGroupsDeleted deletes the node resource groups AKS left behind
+// after deleting the clusters, and fails if there were any.
+func (d *deployer) verifyNodeResourceGroupsDeleted(nodeResourceGroups []string) error {
+	var errs []error
+	for _, nodeResourceGroup := range nodeResourceGroups {
+		resourceGroupID := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", subscriptionID, nodeResourceGroup)
+		exists, err := d.resourceExists(resourcesAPIVersion, resourceGroupID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !exists {
+			klog.Infof("Node resource group %q is deleted", nodeResourceGroup)
+			continue
+		}
+		klog.Warningf("Node resource group %q still exists after its cluster was deleted, deleting it", nodeResourceGroup)
+		if err := d.deleteResource(resourcesAPIVersion, resourceGroupID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, fmt.Errorf("node resource group %q was left behind by its cluster", nodeResourceGroup))
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// clusterConfigWithCustomConfig returns a cluster config with the encoded custom configuration.
+func clusterConfigWithCustomConfig(customConfig string) map[string]interface{} {
+	return map[string]interface{}{
+		"properties": map[string]interface{}{
+			"encodedCustomConfiguration": base64.StdEncoding.EncodeToString([]byte(customConfig)),
+		},
+	}
+}
+
+func TestTagRunID(t *testing.T) {
+	testCases := []struct {
+		name         string
+		customConfig string
+		expectedTags string
+		expectedName string
+		expectErr    bool
+	}{
+		{
+			name:         "default cluster name",
+			customConfig: `{"kubernetesConfigurations": {"kube-cloud-controller-manager": {"image": "ccm", "config": {"--v": "6"}}}}`,
+			expectedTags: "kubetest2-aks-run-id=run",
+			expectedName: "kubernetes",
+		},
+		{
+			name:         "tags and cluster name of the template",
+			customConfig: `{"kubernetesConfigurations": {"kube-cloud-controller-manager": {"config": {"--cluster-name": "e2e"}, "cloudConfig": {"tags": "owner=ci,kubetest2-aks-run-id=old"}}}}`,
+			expectedTags: "owner=ci,kubetest2-aks-run-id=run",
+			expectedName: "e2e",
+		},
+		{
+			name:         "no cloud controller manager",
+			customConfig: `{"kubernetesConfigurations": {"kube-cloud-node-manager": {"image": "cnm"}}}`,
+			expectErr:    true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := clusterConfigWithCustomConfig(tc.customConfig)
+			err := tagRunID(config, "run")
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tag := config["tags"].(map[string]interface{})[runIDTag]; tag != "run" {
+				t.Errorf("expected the cluster to be tagged with the run ID, got %v", tag)
+			}
+
+			// The cloud provider tags its resources with the tags of its cloud config
+			ccm, _, err := ccmConfiguration(config)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			cloudConfig, _ := ccm["cloudConfig"].(map[string]interface{})
+			if tags := cloudConfig["tags"]; tags != tc.expectedTags {
+				t.Errorf("expected cloud config tags %q, got %v", tc.expectedTags, tags)
+			}
+			name, err := ccmClusterName(config)
+			if err != nil || name != tc.expectedName {
+				t.Errorf("expected cloud provider cluster name %q, got %q, %v", tc.expectedName, name, err)
+			}
+		})
+	}
+}
+
+func TestTagRunIDKeepsCustomConfiguration(t *testing.T) {
+	config := clusterConfigWithCustomConfig(`{"kubernetesConfigurations": {"kube-cloud-controller-manager": {"image": "ccm"}, "kube-cloud-node-manager": {"image": "cnm"}}}`)
+	if err := tagRunID(config, "run"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(config["properties"].(map[string]interface{})["encodedCustomConfiguration"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var customConfig struct {
+		KubernetesConfigurations map[string]struct {
+			Image string `json:"image"`
+		} `json:"kubernetesConfigurations"`
+	}
+	if err := json.Unmarshal(data, &customConfig); err != nil {
+		t.Fatal(err)
+	}
+	if image := customConfig.KubernetesConfigurations["kube-cloud-node-manager"].Image; image != "cnm" {
+		t.Errorf("expected the cloud node manager to be kept, got image %q", image)
+	}
+}
+
+func TestCCMResourcesToDelete(t *testing.T) {
+	upAt := time.Date(2022, 8, 1, 10, 0, 0, 0, time.UTC)
+	ours := map[string]string{clusterNameTag: "kubernetes", runIDTag: "run"}
+
+	testCases := []struct {
+		name      string
+		resources []taggedResource
+		expected  []string
+	}{
+		{
+			name: "deletion order",
+			resources: []taggedResource{
+				{ID: "pip", Type: "Microsoft.Network/publicIPAddresses", Tags: ours, CreatedTime: upAt.Add(time.Minute)},
+				{ID: "lb", Type: "Microsoft.Network/loadBalancers", Tags: ours, CreatedTime: upAt.Add(time.Minute)},
+				{ID: "pls", Type: "Microsoft.Network/privateLinkServices", Tags: ours, CreatedTime: upAt.Add(time.Minute)},
+			},
+			expected: []string{"pls", "lb", "pip"},
+		},
+		{
+			name: "other run",
+			resources: []taggedResource{
+				{ID: "other", Type: "Microsoft.Network/publicIPAddresses", Tags: map[string]string{clusterNameTag: "kubernetes", runIDTag: "other"}, CreatedTime: upAt.Add(time.Minute)},
+				{ID: "untagged", Type: "Microsoft.Network/publicIPAddresses", Tags: map[string]string{clusterNameTag: "kubernetes"}, CreatedTime: upAt.Add(time.Minute)},
+				{ID: "not the cloud provider's", Type: "Microsoft.Network/publicIPAddresses", Tags: map[string]string{runIDTag: "run"}, CreatedTime: upAt.Add(time.Minute)},
+				{ID: "another cloud provider's", Type: "Microsoft.Network/publicIPAddresses", Tags: map[string]string{clusterNameTag: "e2e", runIDTag: "run"}, CreatedTime: upAt.Add(time.Minute)},
+				{ID: "pip", Type: "Microsoft.Network/publicIPAddresses", Tags: ours, CreatedTime: upAt.Add(time.Minute)},
+			},
+			expected: []string{"pip"},
+		},
+		{
+			name: "created before Up or at an unknown time",
+			resources: []taggedResource{
+				{ID: "old", Type: "Microsoft.Network/publicIPAddresses", Tags: ours, CreatedTime: upAt.Add(-time.Minute)},
+				{ID: "unknown", Type: "Microsoft.Network/publicIPAddresses", Tags: ours},
+				{ID: "pip", Type: "Microsoft.Network/publicIPAddresses", Tags: ours, CreatedTime: upAt},
+			},
+			expected: []string{"pip"},
+		},
+		{
+			name: "not a network resource",
+			resources: []taggedResource{
+				{ID: "disk", Type: "Microsoft.Compute/disks", Tags: ours, CreatedTime: upAt.Add(time.Minute)},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ids []string
+			for _, r := range ccmResourcesToDelete(tc.resources, "kubernetes", "run", upAt) {
+				ids = append(ids, r.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog"
+)
+
+// createdResource is a resource Up created in a resource group it did not create.
+type createdResource struct {
+	ID         string `json:"id"`
+	APIVersion string `json:"apiVersion"`
+}
+
+// resourceExists returns true if the resource exists.
+func (d *deployer) resourceExists(apiVersion, resourceID string) (bool, error) {
+	armClient, err := d.newArmClientWithAPIVersion(apiVersion)
+	if err != nil {
+		return false, fmt.Errorf("failed to new arm client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+
+	resp, rerr := armClient.GetResource(ctx, resourceID)
+	defer armClient.CloseResponse(ctx, resp)
+	if rerr != nil {
+		if rerr.HTTPStatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get resource %q: %v", resourceID, rerr.Error())
+	}
+	return true, nil
+}
+
+// recordIfNew records the resource in the state file before it is created, so a
+// failed or interrupted creation is cleaned up as well. Existing resources are not
+// recorded since the run must not delete them.
+func (d *deployer) recordIfNew(apiVersion, resourceID string) error {
+	exists, err := d.resourceExists(apiVersion, resourceID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return d.updateState(func(state *runState) {
+		for _, r := range state.CreatedResources {
+			if r.ID == resourceID {
+				return
+			}
+		}
+		state.CreatedResources = append(state.CreatedResources, createdResource{ID: resourceID, APIVersion: apiVersion})
+	})
+}
+
+// deleteResource deletes the resource, succeeding if it does not exist.
+func (d *deployer) deleteResource(apiVersion, resourceID string) error {
+	armClient, err := d.newArmClientWithAPIVersion(apiVersion)
+	if err != nil {
+		return fmt.Errorf("failed to new arm client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+
+	if rerr := armClient.DeleteResource(ctx, resourceID); rerr != nil && rerr.HTTPStatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete resource %q: %v", resourceID, rerr.Error())
+	}
+	return nil
+}
+
+// cleanUpCreatedResources deletes what this run created. The resource group is
+// deleted only if the run created it, otherwise the recorded resources are deleted
+// in the reverse order of creation.
+func (d *deployer) cleanUpCreatedResources(cred *azidentity.DefaultAzureCredential) error {
+	state, err := d.loadState()
+	if err != nil {
+		return err
+	}
+
+	if state.ResourceGroupCreated {
+		if err := d.deleteResourceGroup(subscriptionID, cred, false); err != nil {
+			return err
+		}
+		if err := d.deleteCustomRoleDefinition(); err != nil {
+			return err
+		}
+	} else {
+		var errs []error
+		for i := len(state.CreatedResources) - 1; i >= 0; i-- {
+			r := state.CreatedResources[i]
+			klog.Infof("Deleting resource %q created by this run", r.ID)
+			if err := d.deleteResource(r.APIVersion, r.ID); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) > 0 {
+			return utilerrors.NewAggregate(errs)
+		}
+		klog.Infof("Resource group %q was not created by this run, %d resources created in it are deleted", d.ResourceGroupName, len(state.CreatedResources))
+	}
+
+	return d.updateState(func(state *runState) {
+		state.ResourceGroupCreated = false
+		state.CreatedResources = nil
+		state.Clusters = nil
+		state.MergedKubeconfig = ""
+	})
+}
+
+// cleanUpOnFailure dumps the diagnostics of the clusters and deletes what this run
+// created. The dump is part of Up, on its context.
+func (d *deployer) cleanUpOnFailure(cred *azidentity.DefaultAzureCredential) {
+	klog.Infof("Up failed, dumping diagnostics before cleaning up")
+	if err := d.dumpClusterLogs(); err != nil {
+		klog.Warningf("failed to dump cluster logs: %v", err)
+	}
+	if err := d.cleanUpCreatedResources(cred); err != nil {
+		klog.Errorf("failed to clean up resources created by this run: %v", err)
+	}
+}
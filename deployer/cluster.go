@@ -0,0 +1,161 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/kubetest2/pkg/exec"
+)
+
+// clusterSpec is one entry of --clusters. Empty fields default to the
+// corresponding flags.
+type clusterSpec struct {
+	Name       string `json:"name"`
+	ConfigPath string `json:"config,omitempty"`
+	Location   string `json:"location,omitempty"`
+	K8sVersion string `json:"k8sVersion,omitempty"`
+}
+
+// getClusterSpecs returns the clusters of this run, read from --clusters or
+// the single cluster described by the flags.
+func (d *deployer) getClusterSpecs() ([]clusterSpec, error) {
+	defaults := clusterSpec{
+		Name:       d.ClusterName,
+		ConfigPath: d.ConfigPath,
+		Location:   d.Location,
+		K8sVersion: d.K8sVersion,
+	}
+	if d.ClusterSpecsPath == "" {
+		return []clusterSpec{defaults}, nil
+	}
+
+	data, err := ioutil.ReadFile(d.ClusterSpecsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster specs at %q: %v", d.ClusterSpecsPath, err)
+	}
+	var specs []clusterSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cluster specs: %v", err)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no cluster is specified in %q", d.ClusterSpecsPath)
+	}
+
+	names := map[string]bool{}
+	for i := range specs {
+		spec := &specs[i]
+		if spec.Name == "" {
+			return nil, fmt.Errorf("cluster %d has no name", i)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("cluster %q is specified more than once", spec.Name)
+		}
+		names[spec.Name] = true
+		if spec.ConfigPath == "" {
+			spec.ConfigPath = defaults.ConfigPath
+		}
+		if spec.Location == "" {
+			spec.Location = defaults.Location
+		}
+		if spec.K8sVersion == "" {
+			spec.K8sVersion = defaults.K8sVersion
+		}
+	}
+	return specs, nil
+}
+
+// forCluster returns a copy of the deployer working on the cluster of the spec.
+// Resources shared by the clusters, like the resource group and the virtual
+// network, stay with the original deployer.
+func (d *deployer) forCluster(spec clusterSpec) *deployer {
+	upOptions := *d.UpOptions
+	upOptions.ClusterName = spec.Name
+	upOptions.ConfigPath = spec.ConfigPath
+	upOptions.Location = spec.Location
+	upOptions.K8sVersion = spec.K8sVersion
+
+	c := *d
+	c.UpOptions = &upOptions
+	return &c
+}
+
+// clusters returns a deployer per cluster of the run.
+func (d *deployer) clusters() ([]*deployer, error) {
+	specs, err := d.getClusterSpecs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster specs: %v", err)
+	}
+	var clusters []*deployer
+	for _, spec := range specs {
+		clusters = append(clusters, d.forCluster(spec))
+	}
+	return clusters, nil
+}
+
+// forEachCluster runs f for every cluster concurrently and aggregates the errors.
+func forEachCluster(clusters []*deployer, f func(c *deployer) error) error {
+	errs := make([]error, len(clusters))
+	var wg sync.WaitGroup
+	for i, c := range clusters {
+		wg.Add(1)
+		go func(i int, c *deployer) {
+			defer wg.Done()
+			if err := f(c); err != nil {
+				errs[i] = fmt.Errorf("cluster %q: %v", c.ClusterName, err)
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	return utilerrors.NewAggregate(errs)
+}
+
+func (d *deployer) mergedKubeconfigPath() string {
+	return fmt.Sprintf("%s/%s.merged.kubeconfig", defaultKubeconfigDir, d.ResourceGroupName)
+}
+
+// mergeKubeconfigs writes a kubeconfig with one context per cluster.
+func (d *deployer) mergeKubeconfigs(clusters []*deployer) error {
+	var paths []string
+	for _, c := range clusters {
+		paths = append(paths, c.clusterKubeconfigPath())
+	}
+
+	cmd := exec.CommandContext(d.ctx, "kubectl", "config", "view", "--flatten")
+	cmd.SetEnv(append(os.Environ(), fmt.Sprintf("KUBECONFIG=%s", strings.Join(paths, string(os.PathListSeparator))))...)
+	merged, err := cmdOutput(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to merge kubeconfigs: %v", err)
+	}
+
+	destPath := d.mergedKubeconfigPath()
+	if err := writePrivateFile(destPath, merged); err != nil {
+		return fmt.Errorf("failed to write kubeconfig to %s", destPath)
+	}
+	klog.Infof("Merged kubeconfig of %d clusters is written to %s", len(clusters), destPath)
+	return d.updateState(func(state *runState) {
+		state.MergedKubeconfig = destPath
+	})
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"k8s.io/klog"
+)
+
+var (
+	defaultBuildTimeout = time.Hour
+	defaultUpTimeout    = 2 * time.Hour
+	defaultDownTimeout  = time.Hour
+
+	// dumpLogsGracePeriod bounds dumping the cluster logs in Down after an interruption,
+	// since the deployer is killed soon after.
+	dumpLogsGracePeriod = 10 * time.Minute
+)
+
+// watchSignals cancels the operations in progress on SIGINT or SIGTERM. kubetest2
+// catches the signals as well and calls Down before exiting.
+func (d *deployer) watchSignals() {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.interruptCtx = ctx
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		klog.Warningf("Received %s, cancelling the operations in progress", sig)
+		cancel()
+		if d.ResourceGroupName == "" {
+			return
+		}
+		// What was created so far is already in the state file
+		if err := d.updateState(func(state *runState) {
+			state.Interrupted = sig.String()
+		}); err != nil {
+			klog.Errorf("failed to record the interruption in the state file: %v", err)
+		}
+	}()
+}
+
+// interrupted returns true if the deployer received SIGINT or SIGTERM.
+func (d *deployer) interrupted() bool {
+	return d.interruptCtx != nil && d.interruptCtx.Err() != nil
+}
+
+// withPhaseContext returns a copy of the deployer whose operations are cancelled
+// after timeout or, unless the phase runs after an interruption, on SIGINT or SIGTERM.
+func (d *deployer) withPhaseContext(phase string, timeout time.Duration, interruptible bool) (*deployer, context.CancelFunc) {
+	parent := context.Background()
+	if interruptible && d.interruptCtx != nil {
+		parent = d.interruptCtx
+	}
+	ctx, cancel := parent, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	}
+	c := *d
+	c.ctx = ctx
+	c.phase = phase
+	c.phaseStart = time.Now()
+	return &c, cancel
+}
+
+// phaseError explains why the phase failed if its context is done.
+func (d *deployer) phaseError(err error, timeout time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	switch d.ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%s timed out after %s: %v", d.phase, timeout, err)
+	case context.Canceled:
+		return fmt.Errorf("%s is interrupted: %v", d.phase, err)
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/klog"
+)
+
+var (
+	defaultControlPlaneTier = "Free"
+	defaultLoadBalancerSku  = "Standard"
+
+	hourlyCostTag    = "kubetest2-aks-estimated-hourly-cost"
+	upAtTag          = "kubetest2-aks-up-at"
+	estimatedCostTag = "kubetest2-aks-estimated-cost"
+)
+
+// pricingTable holds the hourly prices used to estimate the cost of a run. It is
+// maintained offline, like cluster-templates/pricing.json.
+type pricingTable struct {
+	Currency string `json:"currency"`
+	// VMSizes are the hourly prices of a VM by size, like Standard_DS2_v2.
+	VMSizes map[string]float64 `json:"vmSizes"`
+	// ControlPlane are the hourly prices of a cluster by SKU tier, like Free or Paid.
+	ControlPlane map[string]float64 `json:"controlPlane"`
+	// LoadBalancers are the hourly prices of a load balancer by SKU, like Basic or Standard.
+	LoadBalancers map[string]float64 `json:"loadBalancers"`
+}
+
+func (d *deployer) loadPricingTable() (*pricingTable, error) {
+	data, err := ioutil.ReadFile(d.PricingFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pricing file %q: %v", d.PricingFile, err)
+	}
+	table := &pricingTable{}
+	if err := json.Unmarshal(data, table); err != nil {
+		return nil, fmt.Errorf("failed to parse pricing file %q: %v", d.PricingFile, err)
+	}
+	return table, nil
+}
+
+// price looks the key up case-insensitively and reports whether it is known.
+func price(prices map[string]float64, key string) (float64, bool) {
+	for k, v := range prices {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// clusterHourlyCost estimates the hourly cost of the cluster from the rendered
+// template: the initial agent pools, the control plane tier and the load balancer.
+func (d *deployer) clusterHourlyCost(table *pricingTable) (float64, error) {
+	config, err := d.renderedClusterConfig()
+	if err != nil {
+		return 0, err
+	}
+	properties, _ := config["properties"].(map[string]interface{})
+
+	var cost float64
+	var unknown []string
+	for size, count := range agentPoolCounts(properties) {
+		p, ok := price(table.VMSizes, size)
+		if !ok {
+			unknown = append(unknown, "VM size "+size)
+		}
+		cost += p * float64(count)
+	}
+
+	tier := defaultControlPlaneTier
+	if sku, ok := config["sku"].(map[string]interface{}); ok {
+		if t, ok := sku["tier"].(string); ok && t != "" {
+			tier = t
+		}
+	}
+	p, ok := price(table.ControlPlane, tier)
+	if !ok {
+		unknown = append(unknown, "control plane tier "+tier)
+	}
+	cost += p
+
+	lbSku := defaultLoadBalancerSku
+	if networkProfile, ok := properties["networkProfile"].(map[string]interface{}); ok {
+		if s, ok := networkProfile["loadBalancerSku"].(string); ok && s != "" {
+			lbSku = s
+		}
+	}
+	p, ok = price(table.LoadBalancers, lbSku)
+	if !ok {
+		unknown = append(unknown, "load balancer SKU "+lbSku)
+	}
+	cost += p
+
+	if len(unknown) > 0 {
+		klog.Warningf("Prices of cluster %q are unknown and counted as 0: %s", d.ClusterName, strings.Join(unknown, ", "))
+	}
+	return cost, nil
+}
+
+// recordHourlyCost estimates the hourly cost of the clusters, records it per cluster
+// in the state file and adds it to the run metadata and resource group tags. Cost
+// accounting never fails Up.
+func (d *deployer) recordHourlyCost(credential azcore.TokenCredential, clusters []*deployer) {
+	if d.PricingFile == "" {
+		return
+	}
+	table, err := d.loadPricingTable()
+	if err != nil {
+		klog.Warningf("failed to estimate cost: %v", err)
+		return
+	}
+	var total float64
+	for _, c := range clusters {
+		cost, err := c.clusterHourlyCost(table)
+		if err != nil {
+			klog.Warningf("failed to estimate cost of cluster %q: %v", c.ClusterName, err)
+			continue
+		}
+		total += cost
+		if err := c.updateClusterState(func(cluster *clusterState) {
+			cluster.HourlyCost = cost
+			cluster.Currency = table.Currency
+		}); err != nil {
+			klog.Warningf("failed to update state: %v", err)
+		}
+	}
+
+	hourlyCost := fmt.Sprintf("%.4f %s", total, table.Currency)
+	klog.Infof("Estimated hourly cost of the run is %s", hourlyCost)
+	if err := d.addRunMetadata("aks-estimated-hourly-cost", hourlyCost); err != nil {
+		klog.Warningf("failed to add the hourly cost to the run metadata: %v", err)
+	}
+	if err := d.tagResourceGroup(credential, map[string]string{
+		hourlyCostTag: hourlyCost,
+		upAtTag:       d.phaseStart.UTC().Format(time.RFC3339),
+	}); err != nil {
+		klog.Warningf("failed to tag the resource group with the hourly cost: %v", err)
+	}
+}
+
+// recordRunCost estimates the cost of the clusters from their hourly cost and the
+// time since Up, and adds it to the run metadata and resource group tags before the
+// clusters are deleted. Cost accounting never fails Down.
+func (d *deployer) recordRunCost(credential azcore.TokenCredential) {
+	state, err := d.loadState()
+	if err != nil {
+		klog.Warningf("failed to estimate cost: %v", err)
+		return
+	}
+	var total float64
+	var currency string
+	var lifetime time.Duration
+	for _, cluster := range state.Clusters {
+		if cluster.UpAt.IsZero() || cluster.Currency == "" {
+			continue
+		}
+		clusterLifetime := time.Since(cluster.UpAt)
+		if clusterLifetime > lifetime {
+			lifetime = clusterLifetime
+		}
+		total += cluster.HourlyCost * clusterLifetime.Hours()
+		currency = cluster.Currency
+	}
+	if lifetime == 0 {
+		return
+	}
+
+	cost := fmt.Sprintf("%.4f %s", total, currency)
+	klog.Infof("Estimated cost of the run over %s is %s", lifetime.Round(time.Second), cost)
+	if err := d.addRunMetadata("aks-estimated-cost", cost); err != nil {
+		klog.Warningf("failed to add the cost to the run metadata: %v", err)
+	}
+	if err := d.tagResourceGroup(credential, map[string]string{
+		estimatedCostTag: cost,
+	}); err != nil {
+		klog.Warningf("failed to tag the resource group with the cost: %v", err)
+	}
+}
+
+// tagResourceGroup merges the tags into the tags of the resource group.
+func (d *deployer) tagResourceGroup(credential azcore.TokenCredential, tags map[string]string) error {
+	tagsClient, err := armresources.NewTagsClient(subscriptionID, credential, d.armClientOptions())
+	if err != nil {
+		return fmt.Errorf("failed to new tags client with sub ID %q: %v", subscriptionID, err)
+	}
+	properties := &armresources.Tags{Tags: map[string]*string{}}
+	for k, v := range tags {
+		properties.Tags[k] = to.StringPtr(v)
+	}
+	operation := armresources.TagsPatchOperationMerge
+	scope := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", subscriptionID, d.ResourceGroupName)
+	_, err = tagsClient.UpdateAtScope(d.ctx, scope, armresources.TagsPatchResource{
+		Operation:  &operation,
+		Properties: properties,
+	}, nil)
+	return err
+}
@@ -0,0 +1,450 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog"
+)
+
+const (
+	controlPlaneLogsStorage      = "storage"
+	controlPlaneLogsLogAnalytics = "logAnalytics"
+)
+
+var (
+	storageAPIVersion            = "2021-09-01"
+	workspaceAPIVersion          = "2021-06-01"
+	diagnosticSettingsAPIVersion = "2021-05-01-preview"
+	blobAPIVersion               = "2020-10-02"
+
+	logAnalyticsQueryURL   = "https://api.loganalytics.io/v1/workspaces/%s/query"
+	logAnalyticsScope      = "https://api.loganalytics.io/.default"
+	diagnosticSettingsName = "kubetest2-aks"
+
+	// controlPlaneLogCategories are the diagnostic log categories of the control plane.
+	controlPlaneLogCategories = []string{"cloud-controller-manager", "kube-apiserver", "kube-controller-manager"}
+
+	// blobHourRegexp matches the hour of a diagnostic logs blob, .../y=2022/m=08/d=01/h=10/m=00/PT1H.json.
+	blobHourRegexp = regexp.MustCompile(`/y=(\d{4})/m=(\d{2})/d=(\d{2})/h=(\d{2})/`)
+)
+
+// controlPlaneLogs records where the diagnostic settings of the cluster send the
+// control-plane logs.
+type controlPlaneLogs struct {
+	// Destination is "storage" or "logAnalytics".
+	Destination string `json:"destination"`
+	// ResourceID is the storage account or the Log Analytics workspace.
+	ResourceID string `json:"resourceID"`
+}
+
+func (d *deployer) verifyControlPlaneLogsFlags() error {
+	switch d.ControlPlaneLogs {
+	case "", controlPlaneLogsStorage, controlPlaneLogsLogAnalytics:
+		return nil
+	}
+	return fmt.Errorf("--controlPlaneLogs must be %q or %q", controlPlaneLogsStorage, controlPlaneLogsLogAnalytics)
+}
+
+// controlPlaneLogsResourceID returns the storage account or the Log Analytics
+// workspace shared by the clusters of the resource group in the location, since
+// diagnostic settings only send logs to a destination in the cluster's region.
+func (d *deployer) controlPlaneLogsResourceID(location string) string {
+	if d.ControlPlaneLogs == controlPlaneLogsStorage {
+		// Storage account names are global, up to 24 lowercase alphanumerics
+		hash := sha256.Sum256([]byte(subscriptionID + "/" + d.ResourceGroupName + "/" + location))
+		name := "kubetest2" + hex.EncodeToString(hash[:])[:15]
+		return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s", subscriptionID, d.ResourceGroupName, name)
+	}
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.OperationalInsights/workspaces/%s-logs-%s", subscriptionID, d.ResourceGroupName, d.ResourceGroupName, location)
+}
+
+// createControlPlaneLogsDestinations creates a storage account or a Log Analytics
+// workspace in each location of the clusters, once, before the clusters are created.
+func (d *deployer) createControlPlaneLogsDestinations(clusters []*deployer) error {
+	var locations []string
+	seen := map[string]bool{}
+	for _, c := range clusters {
+		if !seen[c.Location] {
+			seen[c.Location] = true
+			locations = append(locations, c.Location)
+		}
+	}
+	sort.Strings(locations)
+
+	for _, location := range locations {
+		destinationID := d.controlPlaneLogsResourceID(location)
+		klog.Infof("Creating %s %s for the control-plane logs of clusters in location %q", d.ControlPlaneLogs, destinationID, location)
+		if d.ControlPlaneLogs == controlPlaneLogsStorage {
+			if err := d.putResource(storageAPIVersion, destinationID, map[string]interface{}{
+				"location": location,
+				"kind":     "StorageV2",
+				"sku":      map[string]interface{}{"name": "Standard_LRS"},
+				"properties": map[string]interface{}{
+					"minimumTlsVersion":     "TLS1_2",
+					"allowBlobPublicAccess": false,
+				},
+			}, nil); err != nil {
+				return fmt.Errorf("failed to create storage account in location %q: %v", location, err)
+			}
+			continue
+		}
+		if err := d.putResource(workspaceAPIVersion, destinationID, map[string]interface{}{
+			"location": location,
+			"properties": map[string]interface{}{
+				"sku":             map[string]interface{}{"name": "PerGB2018"},
+				"retentionInDays": 30,
+			},
+		}, nil); err != nil {
+			return fmt.Errorf("failed to create Log Analytics workspace in location %q: %v", location, err)
+		}
+	}
+	return nil
+}
+
+// enableControlPlaneLogs creates the diagnostic settings sending the control-plane
+// logs of the cluster to the destination in its location.
+func (d *deployer) enableControlPlaneLogs() error {
+	if d.ControlPlaneLogs == "" {
+		return nil
+	}
+	destinationID := d.controlPlaneLogsResourceID(d.Location)
+	klog.Infof("Sending control-plane logs of cluster %q to %s", d.ClusterName, destinationID)
+
+	properties := map[string]interface{}{}
+	if d.ControlPlaneLogs == controlPlaneLogsStorage {
+		properties["storageAccountId"] = destinationID
+	} else {
+		properties["workspaceId"] = destinationID
+	}
+
+	var logs []map[string]interface{}
+	for _, category := range controlPlaneLogCategories {
+		logs = append(logs, map[string]interface{}{"category": category, "enabled": true})
+	}
+	properties["logs"] = logs
+	settingsID := fmt.Sprintf("%s/providers/Microsoft.Insights/diagnosticSettings/%s", d.clusterResourceID(), diagnosticSettingsName)
+	if err := d.putResource(diagnosticSettingsAPIVersion, settingsID, map[string]interface{}{
+		"properties": properties,
+	}, nil); err != nil {
+		return fmt.Errorf("failed to create diagnostic settings: %v", err)
+	}
+
+	return d.updateClusterState(func(cluster *clusterState) {
+		cluster.ControlPlaneLogs = &controlPlaneLogs{
+			Destination: d.ControlPlaneLogs,
+			ResourceID:  destinationID,
+		}
+	})
+}
+
+// dumpControlPlaneLogs downloads the control-plane logs of the cluster since Up
+// started, if Up enabled them.
+func (d *deployer) dumpControlPlaneLogs() error {
+	state, err := d.loadState()
+	if err != nil {
+		return err
+	}
+	var logs *controlPlaneLogs
+	for _, cluster := range state.Clusters {
+		if cluster.ClusterName == d.ClusterName {
+			logs = cluster.ControlPlaneLogs
+		}
+	}
+	if logs == nil {
+		return nil
+	}
+
+	dir := filepath.Join(d.clusterLogsDir(), "control-plane")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to mkdir %s: %v", dir, err)
+	}
+	klog.Infof("Dumping control-plane logs of cluster %q to %s", d.ClusterName, dir)
+	start, end := d.diagnosticsWindowStart(), time.Now()
+	if logs.Destination == controlPlaneLogsStorage {
+		return d.dumpControlPlaneLogsFromStorage(dir, logs.ResourceID, start, end)
+	}
+	return d.dumpControlPlaneLogsFromLogAnalytics(dir, logs.ResourceID, start, end)
+}
+
+// writeControlPlaneLog writes the log lines of the category sorted by time.
+func writeControlPlaneLog(dir, category string, lines []string) error {
+	sort.Strings(lines)
+	path := filepath.Join(dir, category+".log")
+	if err := ioutil.WriteFile(path, []byte(redactText(strings.Join(lines, "\n"))), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// dumpControlPlaneLogsFromLogAnalytics queries the workspace for the logs of the
+// cluster. Logs take a few minutes to be ingested.
+func (d *deployer) dumpControlPlaneLogsFromLogAnalytics(dir, workspaceID string, start, end time.Time) error {
+	workspace := struct {
+		Properties struct {
+			CustomerID string `json:"customerId"`
+		} `json:"properties"`
+	}{}
+	if err := d.getResource(workspaceAPIVersion, workspaceID, &workspace); err != nil {
+		return err
+	}
+	cred, err := d.newCredential()
+	if err != nil {
+		return err
+	}
+	token, err := cred.GetToken(d.ctx, policy.TokenRequestOptions{Scopes: []string{logAnalyticsScope}})
+	if err != nil {
+		return fmt.Errorf("failed to get Log Analytics token: %v", err)
+	}
+
+	var errs []error
+	for _, category := range controlPlaneLogCategories {
+		query := fmt.Sprintf(`AzureDiagnostics
+| where ResourceId =~ '%s' and Category == '%s'
+| where TimeGenerated between (datetime(%s) .. datetime(%s))
+| project TimeGenerated, log_s
+| order by TimeGenerated asc`, d.clusterResourceID(), category, start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+		body, err := json.Marshal(map[string]string{"query": query})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, fmt.Sprintf(logAnalyticsQueryURL, workspace.Properties.CustomerID), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		req.Header.Set("Content-Type", "application/json")
+		data, err := doRequest(req)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to query %s logs: %v", category, err))
+			continue
+		}
+		result := struct {
+			Tables []struct {
+				Rows [][]interface{} `json:"rows"`
+			} `json:"tables"`
+		}{}
+		if err := json.Unmarshal(data, &result); err != nil {
+			errs = append(errs, fmt.Errorf("failed to decode %s logs: %v", category, err))
+			continue
+		}
+		var lines []string
+		for _, table := range result.Tables {
+			for _, row := range table.Rows {
+				if len(row) == 2 {
+					lines = append(lines, fmt.Sprintf("%v %v", row[0], row[1]))
+				}
+			}
+		}
+		errs = append(errs, writeControlPlaneLog(dir, category, lines))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// doRequest sends the request and returns the body of a successful response.
+func doRequest(req *http.Request) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, redactBody(data))
+	}
+	return data, nil
+}
+
+// storageAccount accesses the blobs of a storage account with a shared key.
+type storageAccount struct {
+	name string
+	key  []byte
+}
+
+// getStorageAccount lists the keys of the storage account.
+func (d *deployer) getStorageAccount(storageID string) (*storageAccount, error) {
+	armClient, err := d.newArmClientWithAPIVersion(storageAPIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new arm client: %v", err)
+	}
+	resp, rerr := armClient.PostResource(d.ctx, storageID, "listKeys", nil, nil)
+	defer armClient.CloseResponse(d.ctx, resp)
+	if rerr != nil {
+		return nil, fmt.Errorf("failed to list keys of %q: %v", storageID, rerr.Error())
+	}
+	keys := struct {
+		Keys []struct {
+			Value string `json:"value"`
+		} `json:"keys"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("failed to decode keys of %q: %v", storageID, err)
+	}
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("storage account %q has no key", storageID)
+	}
+	addSecretValue(keys.Keys[0].Value)
+	key, err := base64.StdEncoding.DecodeString(keys.Keys[0].Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key of %q: %v", storageID, err)
+	}
+	return &storageAccount{name: filepath.Base(storageID), key: key}, nil
+}
+
+// get sends a GET request to the blob service, authorized with the shared key.
+func (s *storageAccount) get(d *deployer, path string, query url.Values) ([]byte, error) {
+	u := url.URL{
+		Scheme:   "https",
+		Host:     s.name + ".blob.core.windows.net",
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", blobAPIVersion)
+
+	// https://docs.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+	var headers []string
+	for k := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			headers = append(headers, k+":"+req.Header.Get(k)+"\n")
+		}
+	}
+	sort.Strings(headers)
+	resource := "/" + s.name + u.EscapedPath()
+	var params []string
+	for k, v := range query {
+		sort.Strings(v)
+		params = append(params, "\n"+strings.ToLower(k)+":"+strings.Join(v, ","))
+	}
+	sort.Strings(params)
+	stringToSign := http.MethodGet + strings.Repeat("\n", 12) + strings.Join(headers, "") + resource + strings.Join(params, "")
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", s.name, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+	return doRequest(req)
+}
+
+// listBlobs lists the names of the blobs of the container with the prefix.
+func (s *storageAccount) listBlobs(d *deployer, container, prefix string) ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		data, err := s.get(d, "/"+container, query)
+		if err != nil {
+			return names, err
+		}
+		result := struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}{}
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return names, fmt.Errorf("failed to decode blobs of %s: %v", container, err)
+		}
+		for _, blob := range result.Blobs {
+			names = append(names, blob.Name)
+		}
+		if result.NextMarker == "" {
+			return names, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// dumpControlPlaneLogsFromStorage downloads the hourly blobs of the logs of the
+// cluster overlapping the window. Blobs are written about every hour.
+func (d *deployer) dumpControlPlaneLogsFromStorage(dir, storageID string, start, end time.Time) error {
+	account, err := d.getStorageAccount(storageID)
+	if err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("resourceId=%s/", strings.ToUpper(d.clusterResourceID()))
+	var errs []error
+	for _, category := range controlPlaneLogCategories {
+		container := "insights-logs-" + category
+		blobs, err := account.listBlobs(d, container, prefix)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list %s logs: %v", category, err))
+			continue
+		}
+		var lines []string
+		for _, blob := range blobs {
+			m := blobHourRegexp.FindStringSubmatch(blob)
+			if m == nil {
+				continue
+			}
+			hour, err := time.Parse("2006-01-02T15", fmt.Sprintf("%s-%s-%sT%s", m[1], m[2], m[3], m[4]))
+			if err != nil || hour.Add(time.Hour).Before(start) || hour.After(end) {
+				continue
+			}
+			data, err := account.get(d, "/"+container+"/"+blob, url.Values{})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to download %s: %v", blob, err))
+				continue
+			}
+			// Each line is a JSON record
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+			for scanner.Scan() {
+				record := struct {
+					Time       string `json:"time"`
+					Properties struct {
+						Log string `json:"log"`
+					} `json:"properties"`
+				}{}
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+					continue
+				}
+				lines = append(lines, fmt.Sprintf("%s %s", record.Time, strings.TrimRight(record.Properties.Log, "\n")))
+			}
+		}
+		errs = append(errs, writeControlPlaneLog(dir, category, lines))
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -17,14 +17,22 @@ limitations under the License.
 package deployer
 
 import (
+	"bytes"
 	"context"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/octago/sflags/gen/gpflag"
 	"github.com/spf13/pflag"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/klog"
+	"sigs.k8s.io/kubetest2/pkg/metadata"
 	"sigs.k8s.io/kubetest2/pkg/types"
 )
 
@@ -39,7 +47,9 @@ var (
 	clientID       = os.Getenv("AZURE_CLIENT_ID")
 	clientSecret   = os.Getenv("AZURE_CLIENT_SECRET")
 	imageRegistry  = os.Getenv("IMAGE_REGISTRY")
-	ctx            = context.Background()
+
+	// metadataLock serializes updates of the run metadata.
+	metadataLock sync.Mutex
 )
 
 type deployer struct {
@@ -50,8 +60,43 @@ type deployer struct {
 	*UpOptions
 
 	// aks specific details
-	KubeconfigPath    string `flag:"kubeconfig" desc:"--kubeconfig flag for aks create cluster"`
-	ResourceGroupName string `flag:"rgName" desc:"--rgName flag for resource group name"`
+	KubeconfigPath    string        `flag:"kubeconfig" desc:"--kubeconfig flag for aks create cluster"`
+	ResourceGroupName string        `flag:"rgName" desc:"--rgName flag for resource group name"`
+	StateFile         string        `flag:"stateFile" desc:"--stateFile flag for the file recording what Up created, defaults to _state/<rgName>.json"`
+	ARMMaxRetries     int           `flag:"armMaxRetries" desc:"--armMaxRetries flag for the maximum retries of a throttled, transient or conflicting ARM request"`
+	DownTimeout       time.Duration `flag:"downTimeout" desc:"--downTimeout flag for how long Down may take, 0 for no limit"`
+	DownNoWait        bool          `flag:"downNoWait" desc:"--downNoWait flag to start deleting and return without waiting for the deletion to finish"`
+	DownClusterOnly   bool          `flag:"downClusterOnly" desc:"--downClusterOnly flag to delete only the clusters and keep the resource group"`
+	DownOnInterrupt   bool          `flag:"downOnInterrupt" desc:"--downOnInterrupt flag to let Down delete resources when kubetest2 calls it on SIGINT or SIGTERM"`
+	DownDumpLogs      bool          `flag:"downDumpLogs" desc:"--downDumpLogs flag to run DumpClusterLogs before Down deletes anything"`
+
+	NodeLogsConcurrency int           `flag:"nodeLogsConcurrency" desc:"--nodeLogsConcurrency flag for how many nodes DumpClusterLogs collects logs from at a time"`
+	ARMRetryDelay       time.Duration `flag:"armRetryDelay" desc:"--armRetryDelay flag for the initial delay between ARM request retries, doubled on every retry"`
+
+	SnapshotResources     bool `flag:"snapshotResources" desc:"--snapshotResources flag to snapshot the resources of the resource groups after Up and report how they changed before Down"`
+	FailOnLeakedResources bool `flag:"failOnLeakedResources" desc:"--failOnLeakedResources flag to fail Down when resources the cloud provider created during the tests are not deleted, implies --snapshotResources"`
+
+	PricingFile string `flag:"pricingFile" desc:"--pricingFile flag for a JSON table of hourly prices to estimate the cost of the run"`
+
+	ClientSecretFile     string `flag:"clientSecretFile" desc:"--clientSecretFile flag for a file holding the client secret, instead of AZURE_CLIENT_SECRET"`
+	ClientSecretKeyVault string `flag:"clientSecretKeyVault" desc:"--clientSecretKeyVault flag for the identifier of a Key Vault secret holding the client secret, instead of AZURE_CLIENT_SECRET"`
+
+	// customer virtual network created by Up
+	networkSpec *networkSpec
+	subnetIDs   map[string]string
+	// user-assigned identities created by Up
+	controlPlaneIdentity *userAssignedIdentity
+	kubeletIdentity      *userAssignedIdentity
+	// custom role definition of --roleDefinition, shared by the clusters
+	customRoleDefinitionID string
+	// requestedK8sVersion is the version or alias of --k8sVersion, before it is resolved
+	requestedK8sVersion string
+
+	// ctx is the context of the running phase, cancelled on timeout or interruption.
+	ctx          context.Context
+	phase        string
+	phaseStart   time.Time
+	interruptCtx context.Context
 }
 
 // New implements deployer.New for aks
@@ -59,20 +104,120 @@ func New(opts types.Options) (types.Deployer, *pflag.FlagSet) {
 	// create a deployer object and set fields that are not flag controlled
 	d := &deployer{
 		commonOptions: opts,
+		ARMMaxRetries: defaultARMMaxRetries,
+		ARMRetryDelay: defaultARMRetryDelay,
 		// logsDir:       filepath.Join(opts.RunDir(), "logs"),
+
+		BuildOptions: &BuildOptions{BuildTimeout: defaultBuildTimeout},
+		UpOptions:    &UpOptions{UpTimeout: defaultUpTimeout},
+
+		DownTimeout:     defaultDownTimeout,
+		DownOnInterrupt: true,
+
+		NodeLogsConcurrency: defaultNodeLogsConcurrency,
+		ctx:                 context.Background(),
 	}
+	redactLogs()
+	addSecretValue(clientSecret)
+	d.watchSignals()
 	// register flags and return
 	return d, bindFlags(d)
 }
 
 func (d *deployer) DumpClusterLogs() error {
-	return nil
+	d, cancel := d.withPhaseContext("DumpClusterLogs", 0, true)
+	defer cancel()
+	err := d.dumpClusterLogs()
+	d.writePhaseResults(err)
+	return err
+}
+
+// dumpClusterLogsInDown dumps the cluster logs before Down deletes anything. Down runs
+// on interruption as well, so the dump is not cancelled by it, but it is bounded by
+// --downTimeout and, after an interruption, by dumpLogsGracePeriod.
+func (d *deployer) dumpClusterLogsInDown() error {
+	c, cancel := d.withPhaseContext("DumpClusterLogs", 0, false)
+	defer cancel()
+	ctx, cancelDump := context.WithCancel(d.ctx)
+	if d.interrupted() {
+		ctx, cancelDump = context.WithTimeout(d.ctx, dumpLogsGracePeriod)
+	}
+	defer cancelDump()
+	c.ctx = ctx
+	err := c.dumpClusterLogs()
+	c.writePhaseResults(err)
+	return err
+}
+
+// dumpClusterLogs dumps the logs of the clusters within the phase of the deployer,
+// its steps being reported with the phase.
+func (d *deployer) dumpClusterLogs() error {
+	d.defaultClusterName()
+	clusters, err := d.clusters()
+	if err == nil {
+		err = forEachCluster(clusters, func(c *deployer) error {
+			// The Azure view is dumped even if the cluster is unreachable
+			return utilerrors.NewAggregate([]error{
+				c.clusterStep("dump cluster info", c.dumpClusterInfo),
+				c.clusterStep("dump Azure diagnostics", c.dumpAzureDiagnostics),
+				c.clusterStep("dump network", c.dumpNetwork),
+				c.clusterStep("dump node logs", c.dumpNodeLogs),
+				c.clusterStep("dump control-plane logs", c.dumpControlPlaneLogs),
+			})
+		})
+	}
+	return err
+}
+
+// addRunMetadata adds a key to the kubetest2 run metadata.json.
+func (d *deployer) addRunMetadata(key, value string) error {
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	metadataPath := filepath.Join(d.commonOptions.RunDir(), "metadata.json")
+
+	var from io.Reader
+	if data, err := ioutil.ReadFile(metadataPath); err == nil {
+		from = bytes.NewReader(data)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read run metadata %q: %v", metadataPath, err)
+	}
+	meta, err := metadata.NewCustomJSON(from)
+	if err != nil {
+		return fmt.Errorf("failed to parse run metadata %q: %v", metadataPath, err)
+	}
+	if err := meta.Add(key, value); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := meta.Write(&buf); err != nil {
+		return fmt.Errorf("failed to encode run metadata: %v", err)
+	}
+	if err := os.MkdirAll(d.commonOptions.RunDir(), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to mkdir the run dir: %v", err)
+	}
+	return ioutil.WriteFile(metadataPath, buf.Bytes(), 0644)
 }
 
 func (d *deployer) Kubeconfig() (string, error) {
 	if d.KubeconfigPath != "" {
 		return d.KubeconfigPath, nil
 	}
+	if state, err := d.loadState(); err == nil {
+		// The merged kubeconfig points at the private FQDN of private clusters, which
+		// testers running in the virtual network can still use
+		if path, private, err := d.privateKubeconfig(state); private {
+			if err == nil {
+				return filepath.Abs(path)
+			}
+			klog.Warningf("Returning the merged kubeconfig, which may not reach the API servers: %v", err)
+		}
+		// The merged kubeconfig of the clusters created by Up
+		if state.MergedKubeconfig != "" {
+			return filepath.Abs(state.MergedKubeconfig)
+		}
+	}
 	if kconfig, ok := os.LookupEnv("KUBECONFIG"); ok {
 		return kconfig, nil
 	}
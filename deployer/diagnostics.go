@@ -0,0 +1,323 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog"
+)
+
+var (
+	activityLogAPIVersion = "2015-04-01"
+
+	// defaultDiagnosticsWindow is how far back the activity log is read when the
+	// state file does not record when Up started.
+	defaultDiagnosticsWindow = 24 * time.Hour
+	// activityLogMargin is read before Up started, for the clock skew.
+	activityLogMargin = 5 * time.Minute
+
+	bootDiagnosticsSASExpiration = 10
+)
+
+// vmssVM is a VMSS instance with its instance view.
+type vmssVM struct {
+	Name       string `json:"name"`
+	ID         string `json:"id"`
+	InstanceID string `json:"instanceId"`
+	Properties struct {
+		ProvisioningState string `json:"provisioningState"`
+		InstanceView      struct {
+			Statuses []struct {
+				Code  string `json:"code"`
+				Level string `json:"level"`
+			} `json:"statuses"`
+		} `json:"instanceView"`
+	} `json:"properties"`
+}
+
+// failed returns true if the instance failed to provision or reports an error.
+func (vm *vmssVM) failed() bool {
+	if vm.Properties.ProvisioningState != "Succeeded" {
+		return true
+	}
+	for _, status := range vm.Properties.InstanceView.Statuses {
+		if status.Level == "Error" || strings.HasPrefix(status.Code, "ProvisioningState/failed") {
+			return true
+		}
+	}
+	return false
+}
+
+// azureDiagnosticsDir returns the artifacts directory for the Azure view of the cluster.
+func (d *deployer) azureDiagnosticsDir() string {
+	return filepath.Join(d.clusterLogsDir(), "azure")
+}
+
+// getRawResource gets a resource, or a list of resources, as JSON.
+func (d *deployer) getRawResource(apiVersion, resourceID string, decorators ...autorest.PrepareDecorator) ([]byte, error) {
+	armClient, err := d.newArmClientWithAPIVersion(apiVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new arm client: %v", err)
+	}
+	resp, rerr := armClient.GetResource(d.ctx, resourceID, decorators...)
+	defer armClient.CloseResponse(d.ctx, resp)
+	if rerr != nil {
+		return nil, fmt.Errorf("failed to get %q: %v", resourceID, rerr.Error())
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// listRawResources gets all the pages of a list of resources and returns their values.
+func (d *deployer) listRawResources(apiVersion, resourceID string, decorators ...autorest.PrepareDecorator) ([]json.RawMessage, error) {
+	armClient, err := d.newArmClientWithAPIVersion(apiVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new arm client: %v", err)
+	}
+	var values []json.RawMessage
+	resp, rerr := armClient.GetResource(d.ctx, resourceID, decorators...)
+	for {
+		if rerr != nil {
+			armClient.CloseResponse(d.ctx, resp)
+			return values, fmt.Errorf("failed to list %q: %v", resourceID, rerr.Error())
+		}
+		page := struct {
+			Value    []json.RawMessage `json:"value"`
+			NextLink string            `json:"nextLink"`
+		}{}
+		err := json.NewDecoder(resp.Body).Decode(&page)
+		armClient.CloseResponse(d.ctx, resp)
+		if err != nil {
+			return values, fmt.Errorf("failed to decode %q: %v", resourceID, err)
+		}
+		values = append(values, page.Value...)
+		if page.NextLink == "" {
+			return values, nil
+		}
+		req, err := armClient.PrepareGetRequest(d.ctx, autorest.WithBaseURL(page.NextLink))
+		if err != nil {
+			return values, fmt.Errorf("failed to prepare the next page of %q: %v", resourceID, err)
+		}
+		resp, rerr = armClient.Send(d.ctx, req)
+	}
+}
+
+// writeDiagnostics writes the JSON indented and redacted to the file in dir.
+func writeDiagnostics(dir, name string, data []byte) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to mkdir %s: %v", dir, err)
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, []byte(redactBody(data)), "", "  "); err != nil {
+		return fmt.Errorf("failed to indent %s: %v", name, err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, indented.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// diagnosticsWindowStart returns when the activity log of the run starts.
+func (d *deployer) diagnosticsWindowStart() time.Time {
+	state, err := d.loadState()
+	if err == nil {
+		for _, cluster := range state.Clusters {
+			if cluster.ClusterName == d.ClusterName && !cluster.UpAt.IsZero() {
+				return cluster.UpAt.Add(-activityLogMargin)
+			}
+		}
+	}
+	return time.Now().Add(-defaultDiagnosticsWindow)
+}
+
+// dumpAzureDiagnostics dumps the Azure view of the cluster: the managed cluster and
+// its agent pools, the activity log of the cluster and its node resource group during
+// the run, the VMSS with their instance views and the boot diagnostics of the failed
+// instances.
+func (d *deployer) dumpAzureDiagnostics() error {
+	dir := d.azureDiagnosticsDir()
+	klog.Infof("Dumping Azure diagnostics of cluster %q to %s", d.ClusterName, dir)
+	clusterID := d.clusterResourceID()
+	var errs []error
+
+	cluster := struct {
+		Properties struct {
+			NodeResourceGroup string `json:"nodeResourceGroup"`
+		} `json:"properties"`
+	}{}
+	data, err := d.getRawResource(apiVersion, clusterID)
+	if err == nil {
+		err = writeDiagnostics(dir, "managed-cluster.json", data)
+		if jerr := json.Unmarshal(data, &cluster); jerr != nil {
+			err = utilerrors.NewAggregate([]error{err, fmt.Errorf("failed to decode cluster %q: %v", clusterID, jerr)})
+		}
+	}
+	errs = append(errs, err)
+	if data, err := d.getRawResource(apiVersion, clusterID+"/agentPools"); err != nil {
+		errs = append(errs, err)
+	} else {
+		errs = append(errs, writeDiagnostics(dir, "agent-pools.json", data))
+	}
+
+	start, end := d.diagnosticsWindowStart(), time.Now()
+	errs = append(errs, d.dumpActivityLog(dir, "activity-log-cluster.json", start, end, fmt.Sprintf("resourceUri eq '%s'", clusterID)))
+
+	nodeResourceGroup := cluster.Properties.NodeResourceGroup
+	if nodeResourceGroup == "" {
+		return utilerrors.NewAggregate(append(errs, fmt.Errorf("node resource group of cluster %q is unknown", d.ClusterName)))
+	}
+	errs = append(errs, d.dumpActivityLog(dir, "activity-log-node-resource-group.json", start, end, fmt.Sprintf("resourceGroupName eq '%s'", nodeResourceGroup)))
+	errs = append(errs, d.dumpVMSS(dir, nodeResourceGroup))
+	return utilerrors.NewAggregate(errs)
+}
+
+// dumpActivityLog dumps the activity log entries matching the filter in the window.
+func (d *deployer) dumpActivityLog(dir, name string, start, end time.Time, filter string) error {
+	filter = fmt.Sprintf("eventTimestamp ge '%s' and eventTimestamp le '%s' and %s",
+		start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339), filter)
+	events, err := d.listRawResources(activityLogAPIVersion,
+		fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Insights/eventtypes/management/values", subscriptionID),
+		autorest.WithQueryParameters(map[string]interface{}{"$filter": filter}))
+	if err != nil {
+		return fmt.Errorf("failed to get activity log: %v", err)
+	}
+	return writeJSONDiagnostics(dir, name, events)
+}
+
+func writeJSONDiagnostics(dir, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", name, err)
+	}
+	return writeDiagnostics(dir, name, data)
+}
+
+// dumpVMSS dumps the VMSS of the node resource group, their instances with instance
+// views, and the boot diagnostics of the failed instances.
+func (d *deployer) dumpVMSS(dir, nodeResourceGroup string) error {
+	scaleSets, err := d.listRawResources(computeAPIVersion,
+		fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets", subscriptionID, nodeResourceGroup))
+	if err != nil {
+		return err
+	}
+	if err := writeJSONDiagnostics(dir, "vmss.json", scaleSets); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, raw := range scaleSets {
+		vmss := struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}{}
+		if err := json.Unmarshal(raw, &vmss); err != nil {
+			errs = append(errs, fmt.Errorf("failed to decode VMSS: %v", err))
+			continue
+		}
+		if data, err := d.getRawResource(computeAPIVersion, vmss.ID+"/instanceView"); err != nil {
+			errs = append(errs, err)
+		} else {
+			errs = append(errs, writeDiagnostics(dir, fmt.Sprintf("vmss-%s-instance-view.json", vmss.Name), data))
+		}
+
+		instances, err := d.listRawResources(computeAPIVersion, vmss.ID+"/virtualMachines",
+			autorest.WithQueryParameters(map[string]interface{}{"$expand": "instanceView"}))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, writeJSONDiagnostics(dir, fmt.Sprintf("vmss-%s-instances.json", vmss.Name), instances))
+		for _, raw := range instances {
+			vm := vmssVM{}
+			if err := json.Unmarshal(raw, &vm); err != nil {
+				errs = append(errs, fmt.Errorf("failed to decode instance of VMSS %q: %v", vmss.Name, err))
+				continue
+			}
+			if vm.failed() {
+				klog.Infof("Instance %q of VMSS %q failed, dumping its boot diagnostics", vm.InstanceID, vmss.Name)
+				errs = append(errs, d.dumpBootDiagnostics(filepath.Join(dir, "boot-diagnostics"), vm.Name, vm.ID))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// dumpBootDiagnostics downloads the serial console log and the screenshot of the instance.
+func (d *deployer) dumpBootDiagnostics(dir, name, instanceID string) error {
+	armClient, err := d.newArmClientWithAPIVersion(computeAPIVersion)
+	if err != nil {
+		return fmt.Errorf("failed to new arm client: %v", err)
+	}
+	resp, rerr := armClient.PostResource(d.ctx, instanceID, "retrieveBootDiagnosticsData", nil,
+		map[string]interface{}{"sasUriExpirationTimeInMinutes": bootDiagnosticsSASExpiration})
+	defer armClient.CloseResponse(d.ctx, resp)
+	if rerr != nil {
+		return fmt.Errorf("failed to retrieve boot diagnostics of %q: %v", instanceID, rerr.Error())
+	}
+	uris := struct {
+		ConsoleScreenshotBlobURI string `json:"consoleScreenshotBlobUri"`
+		SerialConsoleLogBlobURI  string `json:"serialConsoleLogBlobUri"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&uris); err != nil {
+		return fmt.Errorf("failed to decode boot diagnostics of %q: %v", instanceID, err)
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to mkdir %s: %v", dir, err)
+	}
+	var errs []error
+	if uris.SerialConsoleLogBlobURI != "" {
+		errs = append(errs, d.downloadBlob(uris.SerialConsoleLogBlobURI, filepath.Join(dir, name+"-serial-console.log")))
+	}
+	if uris.ConsoleScreenshotBlobURI != "" {
+		errs = append(errs, d.downloadBlob(uris.ConsoleScreenshotBlobURI, filepath.Join(dir, name+"-screenshot.bmp")))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// downloadBlob downloads a blob by its SAS URI, which is never logged.
+func (d *deployer) downloadBlob(sasURI, path string) error {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodGet, sasURI, nil)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", filepath.Base(path), err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", filepath.Base(path), redactText(err.Error()))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", filepath.Base(path), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: status %d", filepath.Base(path), resp.StatusCode)
+	}
+	// Serial console logs may show cloud-init user data and tokens
+	return ioutil.WriteFile(path, []byte(redactText(string(data))), 0644)
+}
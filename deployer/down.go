@@ -17,40 +17,237 @@ limitations under the License.
 package deployer
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	armcontainerservicev2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v2"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/klog"
 )
 
-func (d *deployer) deleteResourceGroup(subscriptionID string, credential azcore.TokenCredential) error {
+// isNotFound returns true if the Azure SDK error is a 404.
+func isNotFound(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
+
+// deleteResourceGroup deletes the resource group, succeeding if it does not exist.
+// With noWait, it returns once the deletion is accepted.
+func (d *deployer) deleteResourceGroup(subscriptionID string, credential azcore.TokenCredential, noWait bool) error {
 	klog.Infof("Deleting resource group %q", d.ResourceGroupName)
-	rgClient, _ := armresources.NewResourceGroupsClient(subscriptionID, credential, nil)
+	rgClient, err := armresources.NewResourceGroupsClient(subscriptionID, credential, d.armClientOptions())
+	if err != nil {
+		return fmt.Errorf("failed to new resource group client with sub ID %q: %v", subscriptionID, err)
+	}
 
-	poller, err := rgClient.BeginDelete(ctx, d.ResourceGroupName, nil)
+	// A deletion started by a previous invocation is resumed
+	options := &armresources.ResourceGroupsClientBeginDeleteOptions{}
+	op, err := d.getPendingOperation(operationDeleteResourceGroup, d.ResourceGroupName)
+	if err != nil {
+		return err
+	}
+	if op != nil {
+		klog.Infof("Resuming deletion of resource group %q started at %s", d.ResourceGroupName, op.StartedAt.Format(time.RFC3339))
+		options.ResumeToken = op.ResumeToken
+	}
+	poller, err := rgClient.BeginDelete(d.ctx, d.ResourceGroupName, options)
 	if err != nil {
+		if isNotFound(err) {
+			klog.Infof("Resource group %q does not exist", d.ResourceGroupName)
+			return d.removePendingOperations(d.ResourceGroupName)
+		}
 		return fmt.Errorf("failed to begin deleting resource group %q: %v", d.ResourceGroupName, err)
 	}
-	if _, err := poller.PollUntilDone(ctx, nil); err != nil {
+	token, err := poller.ResumeToken()
+	if err != nil {
+		return fmt.Errorf("failed to get the resume token of deleting resource group %q: %v", d.ResourceGroupName, err)
+	}
+	if err := d.savePendingOperation(operationDeleteResourceGroup, d.ResourceGroupName, token); err != nil {
+		return err
+	}
+	if noWait {
+		klog.Infof("Deletion of resource group %q is started", d.ResourceGroupName)
+		return nil
+	}
+	if _, err := poller.PollUntilDone(d.ctx, nil); err != nil && !isNotFound(err) {
 		return fmt.Errorf("failed to poll until deletion of resource group %q is done: %v", d.ResourceGroupName, err)
 	}
-	return nil
+	klog.Infof("Resource group %q deleted", d.ResourceGroupName)
+	return d.removePendingOperations(d.ResourceGroupName)
+}
+
+// deleteCluster deletes the deployer's cluster, succeeding if it does not exist.
+// With noWait, it returns once the deletion is accepted.
+func (d *deployer) deleteCluster(cred azcore.TokenCredential, noWait bool) error {
+	klog.Infof("Deleting cluster %q in resource group %q", d.ClusterName, d.ResourceGroupName)
+	client, err := armcontainerservicev2.NewManagedClustersClient(subscriptionID, cred, d.armClientOptions())
+	if err != nil {
+		return fmt.Errorf("failed to new managed cluster client with sub ID %q: %v", subscriptionID, err)
+	}
+
+	// A deletion started by a previous invocation is resumed
+	clusterID := d.clusterResourceID()
+	options := &armcontainerservicev2.ManagedClustersClientBeginDeleteOptions{}
+	op, err := d.getPendingOperation(operationDeleteCluster, clusterID)
+	if err != nil {
+		return err
+	}
+	if op != nil {
+		klog.Infof("Resuming deletion of cluster %q started at %s", d.ClusterName, op.StartedAt.Format(time.RFC3339))
+		options.ResumeToken = op.ResumeToken
+	}
+	poller, err := client.BeginDelete(d.ctx, d.ResourceGroupName, d.ClusterName, options)
+	if err != nil {
+		if isNotFound(err) {
+			klog.Infof("Cluster %q does not exist", d.ClusterName)
+			return d.removePendingOperations(clusterID)
+		}
+		return fmt.Errorf("failed to begin deleting cluster %q: %v", d.ClusterName, err)
+	}
+	token, err := poller.ResumeToken()
+	if err != nil {
+		return fmt.Errorf("failed to get the resume token of deleting cluster %q: %v", d.ClusterName, err)
+	}
+	if err := d.savePendingOperation(operationDeleteCluster, clusterID, token); err != nil {
+		return err
+	}
+	if noWait {
+		klog.Infof("Deletion of cluster %q is started", d.ClusterName)
+		return nil
+	}
+	if _, err := poller.PollUntilDone(d.ctx, nil); err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to poll until deletion of cluster %q is done: %v", d.ClusterName, err)
+	}
+	klog.Infof("Cluster %q deleted", d.ClusterName)
+	// A pending creation of the cluster is gone as well
+	return d.removePendingOperations(clusterID)
 }
 
 func (d *deployer) Down() error {
+	if d.interrupted() && !d.DownOnInterrupt {
+		klog.Infof("Skipping Down on interruption, the created resources are recorded in %s", d.stateFilePath())
+		return nil
+	}
+	// Down runs on interruption as well, so it is not cancelled by it
+	d, cancel := d.withPhaseContext("Down", d.DownTimeout, false)
+	defer cancel()
+	err := d.phaseError(d.down(), d.DownTimeout)
+	d.writePhaseResults(err)
+	return err
+}
+
+func (d *deployer) down() error {
+	if d.ResourceGroupName == "" {
+		return fmt.Errorf("resource group name is empty")
+	}
+	d.defaultClusterName()
+	state, err := d.loadState()
+	if err != nil {
+		return err
+	}
+	if state.Adopted {
+		klog.Infof("Clusters in resource group %q are adopted, not deleting them", d.ResourceGroupName)
+		return nil
+	}
+	// kubetest2 does not call DumpClusterLogs
+	if d.DownDumpLogs {
+		if err := d.step("dump cluster logs", d.dumpClusterLogsInDown); err != nil {
+			klog.Warningf("failed to dump cluster logs: %v", err)
+		}
+	}
+
 	// Create a credentials object.
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	cred, err := d.newCredential()
 	if err != nil {
-		klog.Fatalf("failed to authenticate: %v", err)
+		return fmt.Errorf("failed to authenticate: %v", err)
 	}
+	d.recordRunCost(cred)
 
-	err = d.deleteResourceGroup(subscriptionID, cred)
+	// Leaked resources fail Down once it deleted what the run created
+	var leakErr error
+	if d.SnapshotResources || d.FailOnLeakedResources {
+		if err := d.step("diff resources", d.diffResourcesBeforeDown); err != nil {
+			if d.FailOnLeakedResources {
+				leakErr = err
+			} else {
+				klog.Warningf("failed to diff resources: %v", err)
+			}
+		}
+	}
+
+	// The node resource groups are unknown once the clusters are deleted, and their
+	// state once the clusters are deleted alone
+	clusters, err := d.clusters()
 	if err != nil {
-		klog.Fatalf("failed to delete resource group %q: %v", d.ResourceGroupName, err)
+		return err
+	}
+	nodeResourceGroups := d.nodeResourceGroups(clusters)
+	clusterStates := map[string]clusterState{}
+	for _, cluster := range state.Clusters {
+		clusterStates[cluster.ClusterName] = cluster
+	}
+	if err := d.deleteRun(cred); err != nil {
+		return utilerrors.NewAggregate([]error{err, leakErr})
+	}
+	if d.DownNoWait {
+		klog.Infof("Not deleting the resources of the cloud provider and the custom role definition while the clusters are being deleted")
+		return leakErr
 	}
 
-	klog.Infof("Resource group %q deleted", d.ResourceGroupName)
-	return nil
+	// Role definitions outlive the resource group, and are in use until it is deleted
+	var roleErr error
+	if !d.DownClusterOnly {
+		roleErr = d.deleteCustomRoleDefinition()
+	}
+
+	// The cloud provider of a deleted cluster no longer recreates its resources
+	return utilerrors.NewAggregate([]error{
+		roleErr,
+		forEachCluster(clusters, func(c *deployer) error {
+			return c.clusterStep("delete cloud provider resources", func() error {
+				return c.deleteCCMResources(clusterStates[c.ClusterName])
+			})
+		}),
+		d.step("verify node resource groups are deleted", func() error {
+			return d.verifyNodeResourceGroupsDeleted(nodeResourceGroups)
+		}),
+		leakErr,
+	})
+}
+
+// deleteRun deletes the clusters, or the resource group with every cluster in it.
+func (d *deployer) deleteRun(cred azcore.TokenCredential) error {
+	if d.DownClusterOnly {
+		clusters, err := d.clusters()
+		if err != nil {
+			return err
+		}
+		if err := forEachCluster(clusters, func(c *deployer) error {
+			return c.clusterStep("delete cluster", func() error {
+				return c.deleteCluster(cred, d.DownNoWait)
+			})
+		}); err != nil {
+			return err
+		}
+		return d.updateState(func(state *runState) {
+			state.Clusters = nil
+			state.MergedKubeconfig = ""
+		})
+	}
+
+	// Deleting the resource group deletes every cluster of the run in it
+	specs, err := d.getClusterSpecs()
+	if err != nil {
+		return fmt.Errorf("failed to get cluster specs: %v", err)
+	}
+	for _, spec := range specs {
+		klog.Infof("Deleting cluster %q with resource group %q", spec.Name, d.ResourceGroupName)
+	}
+	return d.step("delete resource group", func() error {
+		return d.deleteResourceGroup(subscriptionID, cred, d.DownNoWait)
+	})
 }
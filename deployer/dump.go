@@ -0,0 +1,73 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog"
+
+	"sigs.k8s.io/kubetest2/pkg/artifacts"
+	"sigs.k8s.io/kubetest2/pkg/exec"
+)
+
+// clusterLogsDir returns the artifacts directory for logs of the deployer's cluster.
+func (d *deployer) clusterLogsDir() string {
+	return filepath.Join(artifacts.BaseDir(), "clusters", d.ClusterName)
+}
+
+// dumpClusterInfo dumps the Kubernetes view of the cluster with kubectl cluster-info dump.
+func (d *deployer) dumpClusterInfo() error {
+	dir := filepath.Join(d.clusterLogsDir(), "cluster-info")
+	if d.Private {
+		return d.dumpPrivateClusterInfo(dir)
+	}
+	kubeconfig := d.clusterKubeconfigPath()
+	if _, err := os.Stat(kubeconfig); err != nil {
+		return fmt.Errorf("failed to find kubeconfig of cluster %q: %v", d.ClusterName, err)
+	}
+
+	klog.Infof("Dumping cluster info of cluster %q to %s", d.ClusterName, dir)
+	if err := runCmd(exec.CommandContext(d.ctx, "kubectl", "cluster-info", "dump", "--all-namespaces",
+		"--kubeconfig", kubeconfig, "--output-directory", dir)); err != nil {
+		return fmt.Errorf("failed to dump cluster info: %v", err)
+	}
+	return nil
+}
+
+// dumpPrivateClusterInfo dumps the cluster info of a private cluster with command
+// invoke into a single file, since the API server is not reachable from here. The
+// output of command invoke is limited, so it may be truncated.
+func (d *deployer) dumpPrivateClusterInfo(dir string) error {
+	cred, err := d.newCredential()
+	if err != nil {
+		return fmt.Errorf("failed to authenticate: %v", err)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to mkdir %s: %v", dir, err)
+	}
+	path := filepath.Join(dir, "cluster-info.txt")
+	klog.Infof("Dumping cluster info of private cluster %q with command invoke to %s", d.ClusterName, path)
+	output, err := d.kubectlOutput(cred, "cluster-info", "dump", "--all-namespaces")
+	if err != nil {
+		return fmt.Errorf("failed to dump cluster info: %v", err)
+	}
+	return ioutil.WriteFile(path, []byte(redactText(string(output))), 0644)
+}
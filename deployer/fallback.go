@@ -0,0 +1,46 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"k8s.io/klog"
+)
+
+// upLocations returns --location followed by the distinct fallback locations.
+func (d *deployer) upLocations() []string {
+	locations := []string{d.Location}
+	seen := map[string]bool{d.Location: true}
+	for _, location := range d.FallbackLocations {
+		if location == "" || seen[location] {
+			continue
+		}
+		seen[location] = true
+		locations = append(locations, location)
+	}
+	return locations
+}
+
+// cleanUpForFallback deletes the partial resources created in the current location
+// so that Up can start over in the next one.
+func (d *deployer) cleanUpForFallback(cred *azidentity.DefaultAzureCredential) error {
+	if err := d.cleanUpCreatedResources(cred); err != nil {
+		return err
+	}
+	klog.Infof("Resources created in location %q are deleted", d.Location)
+	return nil
+}
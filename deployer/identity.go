@@ -0,0 +1,264 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	identityTypeServicePrincipal = "servicePrincipal"
+	identityTypeSystemAssigned   = "systemAssigned"
+	identityTypeUserAssigned     = "userAssigned"
+)
+
+var (
+	identityAPIVersion      = "2018-11-30"
+	authorizationAPIVersion = "2022-04-01"
+
+	// Built-in role definition IDs
+	managedIdentityOperatorRoleID = "f1a07417-d97a-45cb-824c-7a7467783830"
+	networkContributorRoleID      = "4d97b98b-1d4f-4787-a291-c67834d212e7"
+)
+
+type userAssignedIdentity struct {
+	ID         string `json:"id"`
+	Properties struct {
+		PrincipalID string `json:"principalId"`
+		ClientID    string `json:"clientId"`
+	} `json:"properties"`
+}
+
+// customRoleDefinition is the content of --roleDefinition.
+type customRoleDefinition struct {
+	RoleName    string `json:"roleName"`
+	Description string `json:"description"`
+	Permissions []struct {
+		Actions        []string `json:"actions,omitempty"`
+		NotActions     []string `json:"notActions,omitempty"`
+		DataActions    []string `json:"dataActions,omitempty"`
+		NotDataActions []string `json:"notDataActions,omitempty"`
+	} `json:"permissions"`
+}
+
+func (d *deployer) verifyIdentityFlags() error {
+	switch d.IdentityType {
+	case "":
+		d.IdentityType = identityTypeServicePrincipal
+	case identityTypeServicePrincipal, identityTypeSystemAssigned, identityTypeUserAssigned:
+	default:
+		return fmt.Errorf("identity type %q not supported", d.IdentityType)
+	}
+	if d.RoleDefinitionPath != "" && d.IdentityType != identityTypeUserAssigned {
+		return fmt.Errorf("custom role definition is only supported with %s identity", identityTypeUserAssigned)
+	}
+	return nil
+}
+
+func (d *deployer) resourceGroupScope() string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", subscriptionID, d.ResourceGroupName)
+}
+
+func (d *deployer) createUserAssignedIdentity(name string) (*userAssignedIdentity, error) {
+	klog.Infof("Creating user-assigned identity %q", name)
+	identityID := fmt.Sprintf("%s/providers/Microsoft.ManagedIdentity/userAssignedIdentities/%s", d.resourceGroupScope(), name)
+	identity := &userAssignedIdentity{}
+	if err := d.putResource(identityAPIVersion, identityID, map[string]interface{}{"location": d.Location}, identity); err != nil {
+		return nil, err
+	}
+	if identity.ID == "" {
+		identity.ID = identityID
+	}
+	return identity, nil
+}
+
+// createCustomRoleDefinition creates the custom role assignable in the resource group
+// and returns its role definition ID.
+func (d *deployer) createCustomRoleDefinition() (string, error) {
+	data, err := ioutil.ReadFile(d.RoleDefinitionPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read role definition at %q: %v", d.RoleDefinitionPath, err)
+	}
+	role := customRoleDefinition{}
+	if err := json.Unmarshal(data, &role); err != nil {
+		return "", fmt.Errorf("failed to unmarshal role definition: %v", err)
+	}
+	if role.RoleName == "" {
+		role.RoleName = "kubetest2-aks-ccm"
+	}
+
+	scope := d.resourceGroupScope()
+	// Role names are unique in the tenant, so the name is suffixed with the resource group.
+	roleName := fmt.Sprintf("%s-%s", role.RoleName, d.ResourceGroupName)
+	roleDefinitionID := fmt.Sprintf("%s/providers/Microsoft.Authorization/roleDefinitions/%s", scope, uuid.NewSHA1(uuid.NameSpaceURL, []byte(scope+roleName)))
+	klog.Infof("Creating custom role definition %q", roleName)
+	definition := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"roleName":         roleName,
+			"description":      role.Description,
+			"type":             "CustomRole",
+			"permissions":      role.Permissions,
+			"assignableScopes": []string{scope},
+		},
+	}
+	if err := d.putResource(authorizationAPIVersion, roleDefinitionID, definition, nil); err != nil {
+		return "", err
+	}
+	if err := d.updateState(func(state *runState) {
+		state.CustomRoleDefinitionID = roleDefinitionID
+	}); err != nil {
+		return "", fmt.Errorf("failed to update state: %v", err)
+	}
+	return roleDefinitionID, nil
+}
+
+// deleteCustomRoleDefinition deletes the custom role definition of the run. Role
+// definitions outlive the resource group, so it is deleted once its role assignments
+// are deleted with the resource group.
+func (d *deployer) deleteCustomRoleDefinition() error {
+	state, err := d.loadState()
+	if err != nil {
+		return err
+	}
+	if state.CustomRoleDefinitionID == "" {
+		return nil
+	}
+	klog.Infof("Deleting custom role definition %q", state.CustomRoleDefinitionID)
+	if err := d.deleteResource(authorizationAPIVersion, state.CustomRoleDefinitionID); err != nil {
+		return err
+	}
+	return d.updateState(func(state *runState) {
+		state.CustomRoleDefinitionID = ""
+	})
+}
+
+// assignRole assigns the role to the principal at the scope. Newly created identities
+// take a while to replicate, so PrincipalNotFound errors are retried.
+func (d *deployer) assignRole(scope, roleDefinitionID, principalID string) error {
+	if !strings.HasPrefix(roleDefinitionID, "/") {
+		roleDefinitionID = fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Authorization/roleDefinitions/%s", subscriptionID, roleDefinitionID)
+	}
+	assignmentID := fmt.Sprintf("%s/providers/Microsoft.Authorization/roleAssignments/%s", scope, uuid.NewSHA1(uuid.NameSpaceURL, []byte(scope+roleDefinitionID+principalID)))
+	assignment := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"roleDefinitionId": roleDefinitionID,
+			"principalId":      principalID,
+			"principalType":    "ServicePrincipal",
+		},
+	}
+
+	return wait.PollImmediateWithContext(d.ctx, 10*time.Second, 3*time.Minute, func(ctx context.Context) (done bool, err error) {
+		if err := d.putResource(authorizationAPIVersion, assignmentID, assignment, nil); err != nil {
+			if strings.Contains(err.Error(), "PrincipalNotFound") {
+				klog.Infof("principal %q is not found yet, retrying", principalID)
+				return false, nil
+			}
+			if strings.Contains(err.Error(), "RoleAssignmentExists") {
+				return true, nil
+			}
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// createClusterIdentities creates the user-assigned control plane and kubelet identities
+// and assigns them the roles they need before the cluster is created.
+func (d *deployer) createClusterIdentities() error {
+	if d.IdentityType != identityTypeUserAssigned {
+		return nil
+	}
+
+	controlPlane, err := d.createUserAssignedIdentity(fmt.Sprintf("%s-control-plane", d.ClusterName))
+	if err != nil {
+		return fmt.Errorf("failed to create control plane identity: %v", err)
+	}
+	kubelet, err := d.createUserAssignedIdentity(fmt.Sprintf("%s-kubelet", d.ClusterName))
+	if err != nil {
+		return fmt.Errorf("failed to create kubelet identity: %v", err)
+	}
+
+	// AKS requires the control plane identity to operate the kubelet identity.
+	if err := d.assignRole(kubelet.ID, managedIdentityOperatorRoleID, controlPlane.Properties.PrincipalID); err != nil {
+		return fmt.Errorf("failed to assign Managed Identity Operator role: %v", err)
+	}
+
+	// Only the cloud provider in the control plane manages network resources, the
+	// kubelet identity needs no network access. The custom role definition is
+	// created once for every cluster of the run.
+	roleDefinitionID := networkContributorRoleID
+	if d.customRoleDefinitionID != "" {
+		roleDefinitionID = d.customRoleDefinitionID
+	}
+	if err := d.assignRole(d.resourceGroupScope(), roleDefinitionID, controlPlane.Properties.PrincipalID); err != nil {
+		return fmt.Errorf("failed to assign role %q to identity %q: %v", roleDefinitionID, controlPlane.ID, err)
+	}
+
+	d.controlPlaneIdentity = controlPlane
+	d.kubeletIdentity = kubelet
+	klog.Infof("User-assigned identities for cluster %q are ready", d.ClusterName)
+	return nil
+}
+
+// applyClusterIdentity replaces servicePrincipalProfile in the cluster config with
+// the managed identity settings.
+func (d *deployer) applyClusterIdentity(clusterConfig interface{}) error {
+	if d.IdentityType == identityTypeServicePrincipal {
+		return nil
+	}
+	config, ok := clusterConfig.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("cluster config is not a JSON object")
+	}
+	properties, ok := config["properties"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("cluster config has no properties")
+	}
+	delete(properties, "servicePrincipalProfile")
+
+	if d.IdentityType == identityTypeSystemAssigned {
+		config["identity"] = map[string]interface{}{"type": "SystemAssigned"}
+		return nil
+	}
+
+	if d.controlPlaneIdentity == nil || d.kubeletIdentity == nil {
+		return fmt.Errorf("user-assigned identities are not created")
+	}
+	config["identity"] = map[string]interface{}{
+		"type": "UserAssigned",
+		"userAssignedIdentities": map[string]interface{}{
+			d.controlPlaneIdentity.ID: map[string]interface{}{},
+		},
+	}
+	properties["identityProfile"] = map[string]interface{}{
+		"kubeletidentity": map[string]interface{}{
+			"resourceId": d.kubeletIdentity.ID,
+			"clientId":   d.kubeletIdentity.Properties.ClientID,
+			"objectId":   d.kubeletIdentity.Properties.PrincipalID,
+		},
+	}
+	return nil
+}
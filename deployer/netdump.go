@@ -0,0 +1,268 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog"
+)
+
+var (
+	// networkResourceTypes are dumped from the node resource group, by file name.
+	networkResourceTypes = map[string]string{
+		"load-balancers.json":          "Microsoft.Network/loadBalancers",
+		"public-ip-addresses.json":     "Microsoft.Network/publicIPAddresses",
+		"network-security-groups.json": "Microsoft.Network/networkSecurityGroups",
+		"route-tables.json":            "Microsoft.Network/routeTables",
+		"private-link-services.json":   "Microsoft.Network/privateLinkServices",
+	}
+
+	// Tags set by the cloud provider on the resources of Services.
+	serviceTag      = "k8s-azure-service"
+	ownerServiceTag = "k8s-azure-owner-service"
+
+	networkSummaryFileName = "network-summary.txt"
+)
+
+// networkResource holds the fields of the network resources mapped to Services.
+type networkResource struct {
+	Name       string            `json:"name"`
+	ID         string            `json:"id"`
+	Tags       map[string]string `json:"tags"`
+	Properties struct {
+		IPAddress                string        `json:"ipAddress"`
+		FrontendIPConfigurations []subResource `json:"frontendIPConfigurations"`
+		LoadBalancingRules       []subResource `json:"loadBalancingRules"`
+		Probes                   []subResource `json:"probes"`
+		SecurityRules            []subResource `json:"securityRules"`
+	} `json:"properties"`
+}
+
+type subResource struct {
+	Name string `json:"name"`
+}
+
+// nodeResourceGroup returns the node resource group of the cluster.
+func (d *deployer) nodeResourceGroup() (string, error) {
+	cluster := struct {
+		Properties struct {
+			NodeResourceGroup string `json:"nodeResourceGroup"`
+		} `json:"properties"`
+	}{}
+	if err := d.getResource(apiVersion, d.clusterResourceID(), &cluster); err != nil {
+		return "", err
+	}
+	if cluster.Properties.NodeResourceGroup == "" {
+		return "", fmt.Errorf("node resource group of cluster %q is unknown", d.ClusterName)
+	}
+	return cluster.Properties.NodeResourceGroup, nil
+}
+
+// dumpNetwork dumps the load balancers, public IPs, NSGs, route tables and private
+// link services of the node resource group, and a summary mapping the Services to
+// the resources the cloud provider created for them.
+func (d *deployer) dumpNetwork() error {
+	dir := filepath.Join(d.clusterLogsDir(), "network")
+	klog.Infof("Dumping network resources of cluster %q to %s", d.ClusterName, dir)
+	nodeResourceGroup, err := d.nodeResourceGroup()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	resources := map[string][]networkResource{}
+	for name, resourceType := range networkResourceTypes {
+		values, err := d.listRawResources(networkAPIVersion,
+			fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/%s", subscriptionID, nodeResourceGroup, resourceType))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, writeJSONDiagnostics(dir, name, values))
+		for _, raw := range values {
+			resource := networkResource{}
+			if err := json.Unmarshal(raw, &resource); err != nil {
+				errs = append(errs, fmt.Errorf("failed to decode %s: %v", resourceType, err))
+				continue
+			}
+			resources[resourceType] = append(resources[resourceType], resource)
+		}
+	}
+
+	services, err := d.loadBalancerServices()
+	if err != nil {
+		// The summary is still written from the network resources
+		klog.Warningf("failed to list Services of cluster %q: %v", d.ClusterName, err)
+	}
+	summary := networkSummary(nodeResourceGroup, services, err == nil, resources)
+	path := filepath.Join(dir, networkSummaryFileName)
+	if err := ioutil.WriteFile(path, []byte(summary), 0644); err != nil {
+		errs = append(errs, fmt.Errorf("failed to write %s: %v", path, err))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// loadBalancerServices returns the Services of type LoadBalancer of the cluster.
+func (d *deployer) loadBalancerServices() ([]corev1.Service, error) {
+	cred, err := d.newCredential()
+	if err != nil {
+		return nil, err
+	}
+	output, err := d.kubectlOutput(cred, "get", "services", "--all-namespaces", "-o", "json")
+	if err != nil {
+		return nil, err
+	}
+	list := corev1.ServiceList{}
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal services: %v", err)
+	}
+	var services []corev1.Service
+	for _, service := range list.Items {
+		if service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// loadBalancerPrefix returns the prefix of the names the cloud provider gives to the
+// frontends, rules and probes of the Service.
+func loadBalancerPrefix(service corev1.Service) string {
+	prefix := strings.ReplaceAll("a"+string(service.UID), "-", "")
+	if len(prefix) > 32 {
+		prefix = prefix[:32]
+	}
+	return prefix
+}
+
+func matchingNames(subResources []subResource, prefix string) []string {
+	var names []string
+	for _, s := range subResources {
+		if strings.HasPrefix(s.Name, prefix) {
+			names = append(names, s.Name)
+		}
+	}
+	return names
+}
+
+// taggedWith returns true if the tag lists the Service, as namespace/name.
+func taggedWith(tags map[string]string, tag, service string) bool {
+	for _, s := range strings.Split(tags[tag], ",") {
+		if strings.TrimSpace(s) == service {
+			return true
+		}
+	}
+	return false
+}
+
+// networkSummary maps the Services to the resources the cloud provider created for
+// them, and, if the Services were listed, lists the resources tagged for Services
+// that do not exist.
+func networkSummary(nodeResourceGroup string, services []corev1.Service, servicesListed bool, resources map[string][]networkResource) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Node resource group: %s\n", nodeResourceGroup)
+	for _, resourceType := range sortedKeys(resources) {
+		fmt.Fprintf(&b, "%d %s\n", len(resources[resourceType]), resourceType)
+	}
+
+	known := map[string]bool{}
+	for _, service := range services {
+		name := service.Namespace + "/" + service.Name
+		known[name] = true
+		var ingress []string
+		for _, i := range service.Status.LoadBalancer.Ingress {
+			ingress = append(ingress, i.IP+i.Hostname)
+		}
+		fmt.Fprintf(&b, "\nService %s (ingress %s)\n", name, strings.Join(ingress, ", "))
+		prefix := loadBalancerPrefix(service)
+
+		for _, lb := range resources["Microsoft.Network/loadBalancers"] {
+			frontends := matchingNames(lb.Properties.FrontendIPConfigurations, prefix)
+			rules := matchingNames(lb.Properties.LoadBalancingRules, prefix)
+			probes := matchingNames(lb.Properties.Probes, prefix)
+			if len(frontends)+len(rules)+len(probes) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "  load balancer %s: frontends [%s], rules [%s], probes [%s]\n", lb.Name,
+				strings.Join(frontends, " "), strings.Join(rules, " "), strings.Join(probes, " "))
+		}
+		for _, pip := range resources["Microsoft.Network/publicIPAddresses"] {
+			if taggedWith(pip.Tags, serviceTag, name) || strings.Contains(pip.Name, prefix) {
+				fmt.Fprintf(&b, "  public IP %s: %s\n", pip.Name, pip.Properties.IPAddress)
+			}
+		}
+		for _, nsg := range resources["Microsoft.Network/networkSecurityGroups"] {
+			if rules := matchingNames(nsg.Properties.SecurityRules, prefix); len(rules) > 0 {
+				fmt.Fprintf(&b, "  network security group %s: rules [%s]\n", nsg.Name, strings.Join(rules, " "))
+			}
+		}
+		for _, pls := range resources["Microsoft.Network/privateLinkServices"] {
+			if taggedWith(pls.Tags, ownerServiceTag, name) {
+				fmt.Fprintf(&b, "  private link service %s\n", pls.Name)
+			}
+		}
+	}
+
+	// Resources left behind by deleted Services
+	if !servicesListed {
+		return b.String()
+	}
+	var orphans []string
+	for _, resourceType := range []string{"Microsoft.Network/publicIPAddresses", "Microsoft.Network/privateLinkServices"} {
+		for _, r := range resources[resourceType] {
+			for _, tag := range []string{serviceTag, ownerServiceTag} {
+				for _, s := range strings.Split(r.Tags[tag], ",") {
+					if s = strings.TrimSpace(s); s != "" && !known[s] {
+						orphans = append(orphans, fmt.Sprintf("  %s %s is tagged for Service %s", resourceType, r.Name, s))
+					}
+				}
+			}
+		}
+	}
+	if len(orphans) > 0 {
+		fmt.Fprintf(&b, "\nResources of Services that do not exist\n%s\n", strings.Join(orphans, "\n"))
+	}
+	return b.String()
+}
+
+func sortedKeys(m map[string][]networkResource) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dumpNetworkOnly dumps the network resources of the clusters without creating anything.
+func (d *deployer) dumpNetworkOnly() error {
+	clusters, err := d.clusters()
+	if err != nil {
+		return err
+	}
+	return forEachCluster(clusters, func(c *deployer) error {
+		return c.clusterStep("dump network", c.dumpNetwork)
+	})
+}
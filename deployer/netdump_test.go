@@ -0,0 +1,117 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/json"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestLoadBalancerPrefix(t *testing.T) {
+	testCases := []struct {
+		name     string
+		uid      string
+		expected string
+	}{
+		{name: "truncated", uid: "12345678-1234-1234-1234-123456789012", expected: "a1234567812341234123412345678901"},
+		{name: "short", uid: "1234-abcd", expected: "a1234abcd"},
+		{name: "no UID", uid: "", expected: "a"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{UID: types.UID(tc.uid)}}
+			if prefix := loadBalancerPrefix(service); prefix != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, prefix)
+			}
+		})
+	}
+}
+
+func TestNetworkSummary(t *testing.T) {
+	web := corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "1234-abcd"},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+			Ingress: []corev1.LoadBalancerIngress{{IP: "20.1.2.3"}},
+		}},
+	}
+	resources := map[string][]networkResource{}
+	if err := json.Unmarshal([]byte(`{
+		"Microsoft.Network/loadBalancers": [{
+			"name": "kubernetes",
+			"properties": {
+				"frontendIPConfigurations": [{"name": "a1234abcd"}, {"name": "outbound"}],
+				"loadBalancingRules": [{"name": "a1234abcd-TCP-80"}],
+				"probes": [{"name": "a1234abcd-TCP-80"}]
+			}
+		}],
+		"Microsoft.Network/publicIPAddresses": [
+			{"name": "kubernetes-a1234abcd", "tags": {"k8s-azure-service": "default/web"}, "properties": {"ipAddress": "20.1.2.3"}},
+			{"name": "kubernetes-a5678", "tags": {"k8s-azure-service": "default/gone"}, "properties": {"ipAddress": "20.4.5.6"}}
+		],
+		"Microsoft.Network/networkSecurityGroups": [{
+			"name": "aks-agentpool-nsg",
+			"properties": {"securityRules": [{"name": "a1234abcd-TCP-80-Internet"}, {"name": "other"}]}
+		}]
+	}`), &resources); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name           string
+		services       []corev1.Service
+		servicesListed bool
+		expected       string
+	}{
+		{
+			name:           "Services listed",
+			services:       []corev1.Service{web},
+			servicesListed: true,
+			expected: `Node resource group: MC_rg_cluster_eastus
+1 Microsoft.Network/loadBalancers
+1 Microsoft.Network/networkSecurityGroups
+2 Microsoft.Network/publicIPAddresses
+
+Service default/web (ingress 20.1.2.3)
+  load balancer kubernetes: frontends [a1234abcd], rules [a1234abcd-TCP-80], probes [a1234abcd-TCP-80]
+  public IP kubernetes-a1234abcd: 20.1.2.3
+  network security group aks-agentpool-nsg: rules [a1234abcd-TCP-80-Internet]
+
+Resources of Services that do not exist
+  Microsoft.Network/publicIPAddresses kubernetes-a5678 is tagged for Service default/gone
+`,
+		},
+		{
+			name: "Services not listed",
+			expected: `Node resource group: MC_rg_cluster_eastus
+1 Microsoft.Network/loadBalancers
+1 Microsoft.Network/networkSecurityGroups
+2 Microsoft.Network/publicIPAddresses
+`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if summary := networkSummary("MC_rg_cluster_eastus", tc.services, tc.servicesListed, resources); summary != tc.expected {
+				t.Errorf("expected summary:\n%s\ngot:\n%s", tc.expected, summary)
+			}
+		})
+	}
+}
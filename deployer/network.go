@@ -0,0 +1,221 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+var (
+	networkAPIVersion = "2022-01-01"
+
+	defaultVnetName          = "aks-vnet"
+	defaultSubnetName        = "aks-subnet"
+	defaultRouteTableName    = "aks-routetable"
+	defaultSecurityGroupName = "aks-nsg"
+)
+
+// networkSpec describes a customer virtual network created before the cluster.
+type networkSpec struct {
+	VnetName        string       `json:"vnetName"`
+	AddressPrefixes []string     `json:"addressPrefixes"`
+	Subnets         []subnetSpec `json:"subnets"`
+	// RouteTableName and SecurityGroupName are optional. When set, the route table
+	// or network security group is created and associated with every subnet.
+	RouteTableName    string `json:"routeTableName,omitempty"`
+	SecurityGroupName string `json:"securityGroupName,omitempty"`
+}
+
+type subnetSpec struct {
+	Name          string `json:"name"`
+	AddressPrefix string `json:"addressPrefix"`
+	// AgentPools lists agent pools placed in this subnet. Agent pools not listed
+	// in any subnet are placed in the first subnet.
+	AgentPools []string `json:"agentPools,omitempty"`
+}
+
+// getNetworkSpec returns the virtual network to create from --networkSpec or
+// the network flags, or nil if AKS-managed networking is used.
+func (d *deployer) getNetworkSpec() (*networkSpec, error) {
+	if d.NetworkSpecPath != "" {
+		data, err := ioutil.ReadFile(d.NetworkSpecPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read network spec at %q: %v", d.NetworkSpecPath, err)
+		}
+		spec := &networkSpec{}
+		if err := json.Unmarshal(data, spec); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal network spec: %v", err)
+		}
+		if spec.VnetName == "" {
+			spec.VnetName = defaultVnetName
+		}
+		return spec, nil
+	}
+
+	if d.VnetCIDR == "" {
+		return nil, nil
+	}
+	spec := &networkSpec{
+		VnetName:        defaultVnetName,
+		AddressPrefixes: []string{d.VnetCIDR},
+	}
+	for _, subnet := range d.SubnetCIDRs {
+		parts := strings.SplitN(subnet, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid subnet %q, expected <name>=<cidr>", subnet)
+		}
+		spec.Subnets = append(spec.Subnets, subnetSpec{Name: parts[0], AddressPrefix: parts[1]})
+	}
+	if len(spec.Subnets) == 0 {
+		spec.Subnets = []subnetSpec{{Name: defaultSubnetName, AddressPrefix: d.VnetCIDR}}
+	}
+	if d.RouteTable {
+		spec.RouteTableName = defaultRouteTableName
+	}
+	if d.SecurityGroup {
+		spec.SecurityGroupName = defaultSecurityGroupName
+	}
+	return spec, nil
+}
+
+func (d *deployer) networkResourceID(resourceType, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/%s/%s", subscriptionID, d.ResourceGroupName, resourceType, name)
+}
+
+// createVirtualNetwork creates the virtual network, subnets and the optional route table
+// and network security group described by the network spec.
+func (d *deployer) createVirtualNetwork(spec *networkSpec) error {
+	if len(spec.AddressPrefixes) == 0 || len(spec.Subnets) == 0 {
+		return fmt.Errorf("virtual network %q needs address prefixes and at least one subnet", spec.VnetName)
+	}
+
+	putResource := func(resourceID string, resource interface{}) error {
+		return d.putResource(networkAPIVersion, resourceID, resource, nil)
+	}
+
+	subnetProperties := map[string]interface{}{}
+	if spec.RouteTableName != "" {
+		klog.Infof("Creating route table %q", spec.RouteTableName)
+		routeTableID := d.networkResourceID("routeTables", spec.RouteTableName)
+		if err := putResource(routeTableID, map[string]interface{}{"location": d.Location}); err != nil {
+			return err
+		}
+		subnetProperties["routeTable"] = map[string]interface{}{"id": routeTableID}
+	}
+	if spec.SecurityGroupName != "" {
+		klog.Infof("Creating network security group %q", spec.SecurityGroupName)
+		securityGroupID := d.networkResourceID("networkSecurityGroups", spec.SecurityGroupName)
+		if err := putResource(securityGroupID, map[string]interface{}{"location": d.Location}); err != nil {
+			return err
+		}
+		subnetProperties["networkSecurityGroup"] = map[string]interface{}{"id": securityGroupID}
+	}
+
+	vnetID := d.networkResourceID("virtualNetworks", spec.VnetName)
+	subnets := []interface{}{}
+	for _, subnet := range spec.Subnets {
+		properties := map[string]interface{}{"addressPrefix": subnet.AddressPrefix}
+		for k, v := range subnetProperties {
+			properties[k] = v
+		}
+		subnets = append(subnets, map[string]interface{}{
+			"name":       subnet.Name,
+			"properties": properties,
+		})
+	}
+	vnet := map[string]interface{}{
+		"location": d.Location,
+		"properties": map[string]interface{}{
+			"addressSpace": map[string]interface{}{"addressPrefixes": spec.AddressPrefixes},
+			"subnets":      subnets,
+		},
+	}
+
+	klog.Infof("Creating virtual network %q with %d subnets", spec.VnetName, len(spec.Subnets))
+	if err := putResource(vnetID, vnet); err != nil {
+		return err
+	}
+
+	d.subnetIDs = map[string]string{}
+	for _, subnet := range spec.Subnets {
+		d.subnetIDs[subnet.Name] = fmt.Sprintf("%s/subnets/%s", vnetID, subnet.Name)
+	}
+	d.networkSpec = spec
+	klog.Infof("Virtual network %q in resource group %q is created", spec.VnetName, d.ResourceGroupName)
+	return nil
+}
+
+// subnetIDPlaceholders returns the template placeholders for the created subnets:
+// {VNET_SUBNET_ID} for the first subnet and {VNET_SUBNET_ID:<name>} for each subnet.
+func (d *deployer) subnetIDPlaceholders() map[string]string {
+	placeholders := map[string]string{}
+	if d.networkSpec == nil {
+		return placeholders
+	}
+	placeholders["{VNET_SUBNET_ID}"] = d.subnetIDs[d.networkSpec.Subnets[0].Name]
+	for name, id := range d.subnetIDs {
+		placeholders[fmt.Sprintf("{VNET_SUBNET_ID:%s}", name)] = id
+	}
+	return placeholders
+}
+
+// injectSubnetIDs sets vnetSubnetID of agent pools which do not set it in the template.
+func (d *deployer) injectSubnetIDs(clusterConfig interface{}) error {
+	if d.networkSpec == nil {
+		return nil
+	}
+	config, ok := clusterConfig.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("cluster config is not a JSON object")
+	}
+	properties, ok := config["properties"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("cluster config has no properties")
+	}
+	pools, _ := properties["agentPoolProfiles"].([]interface{})
+
+	poolSubnets := map[string]string{}
+	for _, subnet := range d.networkSpec.Subnets {
+		for _, pool := range subnet.AgentPools {
+			poolSubnets[pool] = d.subnetIDs[subnet.Name]
+		}
+	}
+	defaultSubnetID := d.subnetIDs[d.networkSpec.Subnets[0].Name]
+
+	for _, p := range pools {
+		pool, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if id, ok := pool["vnetSubnetID"].(string); ok && id != "" {
+			continue
+		}
+		name, _ := pool["name"].(string)
+		subnetID, ok := poolSubnets[name]
+		if !ok {
+			subnetID = defaultSubnetID
+		}
+		klog.Infof("Placing agent pool %q in subnet %q", name, subnetID)
+		pool["vnetSubnetID"] = subnetID
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestInjectSubnetIDs(t *testing.T) {
+	spec := &networkSpec{
+		VnetName: "aks-vnet",
+		Subnets: []subnetSpec{
+			{Name: "default"},
+			{Name: "windows", AgentPools: []string{"win"}},
+		},
+	}
+	subnetIDs := map[string]string{
+		"default": "/vnet/subnets/default",
+		"windows": "/vnet/subnets/windows",
+	}
+
+	testCases := []struct {
+		name      string
+		spec      *networkSpec
+		config    string
+		expected  map[string]string
+		expectErr bool
+	}{
+		{
+			name:     "AKS-managed networking",
+			config:   `{"properties": {"agentPoolProfiles": [{"name": "nodepool1"}]}}`,
+			expected: map[string]string{"nodepool1": ""},
+		},
+		{
+			name:     "unlisted pools go to the first subnet",
+			spec:     spec,
+			config:   `{"properties": {"agentPoolProfiles": [{"name": "nodepool1"}, {"name": "win"}]}}`,
+			expected: map[string]string{"nodepool1": "/vnet/subnets/default", "win": "/vnet/subnets/windows"},
+		},
+		{
+			name:     "template subnet is kept",
+			spec:     spec,
+			config:   `{"properties": {"agentPoolProfiles": [{"name": "win", "vnetSubnetID": "/other"}]}}`,
+			expected: map[string]string{"win": "/other"},
+		},
+		{
+			name:      "no properties",
+			spec:      spec,
+			config:    `{}`,
+			expectErr: true,
+		},
+		{
+			name:      "not an object",
+			spec:      spec,
+			config:    `[]`,
+			expectErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &deployer{networkSpec: tc.spec, subnetIDs: subnetIDs}
+			var config interface{}
+			if err := json.Unmarshal([]byte(tc.config), &config); err != nil {
+				t.Fatal(err)
+			}
+			err := d.injectSubnetIDs(config)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			actual := map[string]string{}
+			properties := config.(map[string]interface{})["properties"].(map[string]interface{})
+			for _, p := range properties["agentPoolProfiles"].([]interface{}) {
+				pool := p.(map[string]interface{})
+				id, _ := pool["vnetSubnetID"].(string)
+				actual[pool["name"].(string)] = id
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected subnets %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Azure/go-autorest/autorest"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog"
+)
+
+var (
+	defaultNodeLogsConcurrency = 10
+
+	// nodeLogCommands are the commands printing the node logs, by log name.
+	nodeLogCommands = map[string]string{
+		"kubelet":    "journalctl -u kubelet --no-pager -o short-precise",
+		"containerd": "journalctl -u containerd --no-pager -o short-precise",
+		"cloud-init": "cat /var/log/cloud-init.log /var/log/cloud-init-output.log",
+		"waagent":    "cat /var/log/waagent.log",
+		"dmesg":      "dmesg -T",
+	}
+
+	// The output of a run command is truncated to its last 4096 bytes, so the script
+	// halves the tail of the log until it fits once compressed and encoded, and prints
+	// the size of the tail before it. Only this tail of each log is collected.
+	nodeLogScript = `n=1048576
+while true; do
+  out=$(%s 2>&1 | tail -c $n | gzip -9 | base64 -w0)
+  if [ ${#out} -le 3800 ] || [ $n -le 1024 ]; then break; fi
+  n=$((n / 2))
+done
+echo "$n $out"`
+)
+
+// vmssNode is a Linux or Windows VMSS instance, the node being its computer name.
+type vmssNode struct {
+	ID         string `json:"id"`
+	Properties struct {
+		OSProfile struct {
+			ComputerName         string           `json:"computerName"`
+			WindowsConfiguration *json.RawMessage `json:"windowsConfiguration"`
+		} `json:"osProfile"`
+	} `json:"properties"`
+}
+
+// dumpNodeLogs collects the logs of every node of the cluster with VMSS run commands,
+// which work without SSH and on NotReady nodes.
+func (d *deployer) dumpNodeLogs() error {
+	nodeResourceGroup, err := d.nodeResourceGroup()
+	if err != nil {
+		return err
+	}
+	scaleSets, err := d.listRawResources(computeAPIVersion,
+		fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets", subscriptionID, nodeResourceGroup))
+	if err != nil {
+		return err
+	}
+	var nodes []vmssNode
+	for _, raw := range scaleSets {
+		vmss := struct {
+			ID string `json:"id"`
+		}{}
+		if err := json.Unmarshal(raw, &vmss); err != nil {
+			return fmt.Errorf("failed to decode VMSS: %v", err)
+		}
+		instances, err := d.listRawResources(computeAPIVersion, vmss.ID+"/virtualMachines")
+		if err != nil {
+			return err
+		}
+		for _, raw := range instances {
+			node := vmssNode{}
+			if err := json.Unmarshal(raw, &node); err != nil {
+				return fmt.Errorf("failed to decode instance of VMSS %q: %v", vmss.ID, err)
+			}
+			nodes = append(nodes, node)
+		}
+	}
+
+	dir := filepath.Join(d.clusterLogsDir(), "nodes")
+	klog.Infof("Collecting logs of %d nodes of cluster %q to %s", len(nodes), d.ClusterName, dir)
+	concurrency := d.NodeLogsConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultNodeLogsConcurrency
+	}
+	// The run commands of an instance run one at a time, so the instances are the unit of concurrency
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node vmssNode) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = d.collectNodeLogs(filepath.Join(dir, node.Properties.OSProfile.ComputerName), node)
+		}(i, node)
+	}
+	wg.Wait()
+	return utilerrors.NewAggregate(errs)
+}
+
+// collectNodeLogs runs the log commands on the node one by one and writes their output.
+func (d *deployer) collectNodeLogs(dir string, node vmssNode) error {
+	name := node.Properties.OSProfile.ComputerName
+	if node.Properties.OSProfile.WindowsConfiguration != nil {
+		klog.Infof("Skipping logs of Windows node %q", name)
+		return nil
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to mkdir %s: %v", dir, err)
+	}
+
+	var logNames []string
+	for logName := range nodeLogCommands {
+		logNames = append(logNames, logName)
+	}
+	sort.Strings(logNames)
+
+	var errs []error
+	for _, logName := range logNames {
+		output, err := d.runShellScript(node.ID, fmt.Sprintf(nodeLogScript, nodeLogCommands[logName]))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get %s log of node %q: %v", logName, name, err))
+			continue
+		}
+		tailSize, log, err := decodeNodeLog(output)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to decode %s log of node %q: %v", logName, name, err))
+			continue
+		}
+		// The name tells the log is not complete
+		path := filepath.Join(dir, logName+".tail.log")
+		header := fmt.Sprintf("# Last %s bytes at most of: %s\n", tailSize, nodeLogCommands[logName])
+		if err := ioutil.WriteFile(path, []byte(header+redactText(string(log))), 0644); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write %s: %v", path, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// runShellScript runs the script on the VMSS instance and returns its stdout.
+func (d *deployer) runShellScript(instanceID, script string) (string, error) {
+	armClient, err := d.newArmClientWithAPIVersion(computeAPIVersion)
+	if err != nil {
+		return "", fmt.Errorf("failed to new arm client: %v", err)
+	}
+	req, err := armClient.PreparePostRequest(d.ctx,
+		autorest.WithPathParameters("{resourceID}/runCommand", map[string]interface{}{"resourceID": instanceID}),
+		autorest.WithJSON(map[string]interface{}{
+			"commandId": "RunShellScript",
+			"script":    strings.Split(script, "\n"),
+		}))
+	if err != nil {
+		return "", fmt.Errorf("failed to prepare run command: %v", err)
+	}
+	future, resp, rerr := armClient.SendAsync(d.ctx, req)
+	armClient.CloseResponse(d.ctx, resp)
+	if rerr != nil {
+		return "", rerr.Error()
+	}
+	resp, err = armClient.WaitForAsyncOperationResult(d.ctx, future, "runCommand")
+	defer armClient.CloseResponse(d.ctx, resp)
+	if err != nil {
+		return "", err
+	}
+
+	result := struct {
+		Value []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"value"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode run command result: %v", err)
+	}
+	for _, v := range result.Value {
+		// The message is "Enable succeeded: \n[stdout]\n...\n[stderr]\n..."
+		if i := strings.Index(v.Message, "[stdout]\n"); i >= 0 {
+			stdout := v.Message[i+len("[stdout]\n"):]
+			if j := strings.Index(stdout, "\n[stderr]"); j >= 0 {
+				stdout = stdout[:j]
+			}
+			return stdout, nil
+		}
+	}
+	return "", fmt.Errorf("run command returned no output")
+}
+
+// decodeNodeLog decodes the compressed and encoded tail of a log, returning the size
+// of the tail the script kept.
+func decodeNodeLog(output string) (string, []byte, error) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return "", nil, fmt.Errorf("expected the tail size and the encoded log, got %d fields", len(fields))
+	}
+	data, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", nil, err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+	log, err := ioutil.ReadAll(r)
+	return fields[0], log, err
+}
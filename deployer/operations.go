@@ -0,0 +1,143 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"k8s.io/klog"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/armclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+const (
+	operationCreateCluster       = "createCluster"
+	operationDeleteCluster       = "deleteCluster"
+	operationDeleteResourceGroup = "deleteResourceGroup"
+)
+
+// pendingOperation is a long-running ARM operation in flight. It is recorded in
+// the state file so that a later invocation waits on it instead of starting a
+// conflicting one.
+type pendingOperation struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	// ResumeToken is the resume token of an Azure SDK poller, or the JSON of an
+	// autorest future holding the operation URL.
+	ResumeToken string    `json:"resumeToken"`
+	StartedAt   time.Time `json:"startedAt"`
+}
+
+// getPendingOperation returns the pending operation of the kind on the target, or nil.
+func (d *deployer) getPendingOperation(kind, target string) (*pendingOperation, error) {
+	state, err := d.loadState()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range state.PendingOperations {
+		if op.Kind == kind && op.Target == target {
+			return &op, nil
+		}
+	}
+	return nil, nil
+}
+
+// savePendingOperation records the operation, replacing the one of the same kind on the target.
+func (d *deployer) savePendingOperation(kind, target, resumeToken string) error {
+	return d.updateState(func(state *runState) {
+		op := pendingOperation{Kind: kind, Target: target, ResumeToken: resumeToken, StartedAt: time.Now()}
+		for i := range state.PendingOperations {
+			if state.PendingOperations[i].Kind == kind && state.PendingOperations[i].Target == target {
+				state.PendingOperations[i] = op
+				return
+			}
+		}
+		state.PendingOperations = append(state.PendingOperations, op)
+	})
+}
+
+// removePendingOperations removes the operations on the target, of any kind if kinds is empty.
+func (d *deployer) removePendingOperations(target string, kinds ...string) error {
+	return d.updateState(func(state *runState) {
+		var remaining []pendingOperation
+		for _, op := range state.PendingOperations {
+			matched := op.Target == target
+			if matched && len(kinds) > 0 {
+				matched = false
+				for _, kind := range kinds {
+					matched = matched || op.Kind == kind
+				}
+			}
+			if !matched {
+				remaining = append(remaining, op)
+			}
+		}
+		state.PendingOperations = remaining
+	})
+}
+
+// waitForFuture waits on the autorest future of the operation and removes it from
+// the state file once it is done.
+func (d *deployer) waitForFuture(armClient *armclient.Client, kind, target string, future *azure.Future) (*http.Response, error) {
+	resp, err := armClient.WaitForAsyncOperationResult(d.ctx, future, kind)
+	if d.ctx.Err() != nil {
+		// Interrupted or timed out, the operation is still pending
+		return resp, err
+	}
+	if rerr := d.removePendingOperations(target, kind); rerr != nil {
+		klog.Warningf("failed to remove pending operation %s of %q: %v", kind, target, rerr)
+	}
+	if err != nil {
+		return resp, retry.GetError(resp, err).Error()
+	}
+	return resp, nil
+}
+
+// putResourceResumable puts the resource and records the operation while waiting.
+// If an operation of the kind on the resource is pending, it waits on it instead.
+func (d *deployer) putResourceResumable(armClient *armclient.Client, kind, resourceID string, put func() (*azure.Future, *retry.Error)) (*http.Response, error) {
+	op, err := d.getPendingOperation(kind, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	if op != nil {
+		future := &azure.Future{}
+		err := json.Unmarshal([]byte(op.ResumeToken), future)
+		if err == nil {
+			klog.Infof("Resuming %s of %q started at %s", kind, resourceID, op.StartedAt.Format(time.RFC3339))
+			return d.waitForFuture(armClient, kind, resourceID, future)
+		}
+		klog.Warningf("failed to resume %s of %q, starting it again: %v", kind, resourceID, err)
+	}
+
+	future, rerr := put()
+	if rerr != nil {
+		return nil, rerr.Error()
+	}
+	token, err := json.Marshal(future)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the future of %s: %v", kind, err)
+	}
+	if err := d.savePendingOperation(kind, resourceID, string(token)); err != nil {
+		return nil, err
+	}
+	return d.waitForFuture(armClient, kind, resourceID, future)
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"sigs.k8s.io/kubetest2/pkg/exec"
+)
+
+var (
+	defaultPostUpTimeout = 10 * time.Minute
+
+	// rolloutKinds are the kinds kubectl rollout status can wait on.
+	rolloutKinds = map[string]bool{
+		"Deployment":  true,
+		"DaemonSet":   true,
+		"StatefulSet": true,
+	}
+)
+
+// helmChart is an entry of --postUpHelmCharts: [<namespace>/]<release>=<chart>.
+type helmChart struct {
+	Namespace  string
+	Release    string
+	Chart      string
+	ValuesPath string
+}
+
+func (d *deployer) verifyPostUpFlags() error {
+	if len(d.PostUpManifests) == 0 && len(d.PostUpHelmCharts) == 0 {
+		return nil
+	}
+	if d.Private {
+		return fmt.Errorf("post-Up installation needs a public API server")
+	}
+	if d.PostUpTimeout == 0 {
+		d.PostUpTimeout = defaultPostUpTimeout
+	}
+	_, err := d.getHelmCharts()
+	return err
+}
+
+func (d *deployer) getHelmCharts() ([]helmChart, error) {
+	values := map[string]string{}
+	for _, v := range d.PostUpHelmValues {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid helm values %q, expected <release>=<values file>", v)
+		}
+		values[parts[0]] = parts[1]
+	}
+
+	var charts []helmChart
+	for _, c := range d.PostUpHelmCharts {
+		parts := strings.SplitN(c, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid helm chart %q, expected [<namespace>/]<release>=<chart>", c)
+		}
+		chart := helmChart{Namespace: "default", Release: parts[0], Chart: parts[1]}
+		if i := strings.Index(chart.Release, "/"); i >= 0 {
+			chart.Namespace, chart.Release = chart.Release[:i], chart.Release[i+1:]
+		}
+		chart.ValuesPath = values[chart.Release]
+		delete(values, chart.Release)
+		charts = append(charts, chart)
+	}
+	for release := range values {
+		return nil, fmt.Errorf("helm values are set for release %q which is not in --postUpHelmCharts", release)
+	}
+	return charts, nil
+}
+
+// applyManifest applies a manifest file, directory or URL and waits until the
+// workloads in it are rolled out.
+func (d *deployer) applyManifest(kubeconfig, manifest string) error {
+	klog.Infof("Applying manifest %q to cluster %q", manifest, d.ClusterName)
+	output, err := cmdOutput(exec.CommandContext(d.ctx, "kubectl", "apply", "--kubeconfig", kubeconfig, "-R", "-f", manifest,
+		"-o", `jsonpath={.kind}/{.metadata.name} {.metadata.namespace}{"\n"}`))
+	if err != nil {
+		return fmt.Errorf("failed to apply manifest %q: %v", manifest, err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		resource := fields[0]
+		if !rolloutKinds[strings.SplitN(resource, "/", 2)[0]] {
+			continue
+		}
+		args := []string{"rollout", "status", "--kubeconfig", kubeconfig, resource, fmt.Sprintf("--timeout=%s", d.PostUpTimeout)}
+		if len(fields) > 1 {
+			args = append(args, "-n", fields[1])
+		}
+		if err := runCmd(exec.CommandContext(d.ctx, "kubectl", args...)); err != nil {
+			return fmt.Errorf("%s from manifest %q is not rolled out: %v", resource, manifest, err)
+		}
+	}
+	return nil
+}
+
+// installHelmChart installs or upgrades the chart and waits until its resources are ready.
+func (d *deployer) installHelmChart(kubeconfig string, chart helmChart) error {
+	klog.Infof("Installing helm chart %q as release %q in namespace %q of cluster %q", chart.Chart, chart.Release, chart.Namespace, d.ClusterName)
+	args := []string{"upgrade", "--install", chart.Release, chart.Chart,
+		"--kubeconfig", kubeconfig,
+		"--namespace", chart.Namespace, "--create-namespace",
+		"--wait", fmt.Sprintf("--timeout=%s", d.PostUpTimeout),
+	}
+	if chart.ValuesPath != "" {
+		args = append(args, "--values", chart.ValuesPath)
+	}
+	if err := runCmd(exec.CommandContext(d.ctx, "helm", args...)); err != nil {
+		return fmt.Errorf("failed to install helm chart %q: %v", chart.Chart, err)
+	}
+	return nil
+}
+
+// installPostUp applies the post-Up manifests and helm charts to the cluster.
+func (d *deployer) installPostUp() error {
+	charts, err := d.getHelmCharts()
+	if err != nil {
+		return err
+	}
+	kubeconfig := d.clusterKubeconfigPath()
+	for _, manifest := range d.PostUpManifests {
+		if err := d.applyManifest(kubeconfig, manifest); err != nil {
+			return err
+		}
+	}
+	for _, chart := range charts {
+		if err := d.installHelmChart(kubeconfig, chart); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,495 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/klog"
+)
+
+var (
+	subscriptionsAPIVersion = "2020-01-01"
+	featuresAPIVersion      = "2021-07-01"
+	resourceSkusAPIVersion  = "2021-07-01"
+
+	// Naming rules of https://docs.microsoft.com/azure/azure-resource-manager/management/resource-name-rules
+	resourceGroupNameRegexp = regexp.MustCompile(`^[-\w\._\(\)]{1,90}$`)
+	clusterNameRegexp       = regexp.MustCompile(`^[a-zA-Z0-9]([-_a-zA-Z0-9]{0,61}[a-zA-Z0-9])?$`)
+
+	// requiredFeatures are the preview features of Microsoft.ContainerService the
+	// cluster is created with.
+	requiredFeatures = []string{"EnableCloudControllerManager"}
+
+	dockerHubRegistry = "registry-1.docker.io"
+	registryTimeout   = 30 * time.Second
+	// manifestMediaTypes are the manifests and manifest lists of single and multi-arch images.
+	manifestMediaTypes = []string{
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+		"application/vnd.oci.image.index.v1+json",
+		"application/vnd.oci.image.manifest.v1+json",
+	}
+	// bearerChallengeRegexp matches the parameters of a WWW-Authenticate Bearer challenge.
+	bearerChallengeRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// vmSku is the part of a compute resource SKU preflight needs.
+type vmSku struct {
+	Name         string `json:"name"`
+	ResourceType string `json:"resourceType"`
+	Family       string `json:"family"`
+	Capabilities []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"capabilities"`
+	Restrictions []struct {
+		ReasonCode string `json:"reasonCode"`
+	} `json:"restrictions"`
+}
+
+type computeUsage struct {
+	Name struct {
+		Value string `json:"value"`
+	} `json:"name"`
+	CurrentValue int `json:"currentValue"`
+	Limit        int `json:"limit"`
+}
+
+// getResource gets a resource with the API version and decodes it into result.
+func (d *deployer) getResource(apiVersion, resourceID string, result interface{}, decorators ...autorest.PrepareDecorator) error {
+	armClient, err := d.newArmClientWithAPIVersion(apiVersion)
+	if err != nil {
+		return fmt.Errorf("failed to new arm client: %v", err)
+	}
+	resp, rerr := armClient.GetResource(d.ctx, resourceID, decorators...)
+	defer armClient.CloseResponse(d.ctx, resp)
+	if rerr != nil {
+		return fmt.Errorf("failed to get %q: %v", resourceID, rerr.Error())
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode %q: %v", resourceID, err)
+	}
+	return nil
+}
+
+// requiredProviders returns the resource providers Up creates resources with.
+func (d *deployer) requiredProviders() []string {
+	providers := []string{"Microsoft.ContainerService", "Microsoft.Network", "Microsoft.Compute"}
+	if d.IdentityType == identityTypeUserAssigned {
+		providers = append(providers, "Microsoft.ManagedIdentity")
+	}
+	switch d.ControlPlaneLogs {
+	case controlPlaneLogsStorage:
+		providers = append(providers, "Microsoft.Storage", "Microsoft.Insights")
+	case controlPlaneLogsLogAnalytics:
+		providers = append(providers, "Microsoft.OperationalInsights", "Microsoft.Insights")
+	}
+	return providers
+}
+
+func (d *deployer) preflightNames(clusters []*deployer) []string {
+	var problems []string
+	if !resourceGroupNameRegexp.MatchString(d.ResourceGroupName) || strings.HasSuffix(d.ResourceGroupName, ".") {
+		problems = append(problems, fmt.Sprintf("resource group name %q is invalid: up to 90 alphanumerics, underscores, parentheses, hyphens and periods, not ending with a period", d.ResourceGroupName))
+	}
+	for _, c := range clusters {
+		if !clusterNameRegexp.MatchString(c.ClusterName) {
+			problems = append(problems, fmt.Sprintf("cluster name %q is invalid: up to 63 alphanumerics, underscores and hyphens, starting and ending with an alphanumeric", c.ClusterName))
+		}
+	}
+	return problems
+}
+
+func (d *deployer) preflightSubscription(cred *azidentity.DefaultAzureCredential) []string {
+	var problems []string
+	subscription := struct {
+		State string `json:"state"`
+	}{}
+	if err := d.getResource(subscriptionsAPIVersion, fmt.Sprintf("/subscriptions/%s", subscriptionID), &subscription); err != nil {
+		return []string{fmt.Sprintf("subscription %q is not accessible: %v", subscriptionID, err)}
+	}
+	if subscription.State != "Enabled" {
+		problems = append(problems, fmt.Sprintf("subscription %q is %s", subscriptionID, subscription.State))
+	}
+
+	providersClient, err := armresources.NewProvidersClient(subscriptionID, cred, d.armClientOptions())
+	if err != nil {
+		return append(problems, fmt.Sprintf("failed to new providers client: %v", err))
+	}
+	for _, namespace := range d.requiredProviders() {
+		provider, err := providersClient.Get(d.ctx, namespace, nil)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("failed to get resource provider %s: %v", namespace, err))
+			continue
+		}
+		if state := to.String(provider.RegistrationState); state != "Registered" {
+			problems = append(problems, fmt.Sprintf("resource provider %s is %s, register it with: az provider register -n %s", namespace, state, namespace))
+		}
+	}
+
+	features := append([]string{}, requiredFeatures...)
+	if d.APIServerVnetIntegration {
+		features = append(features, "EnableAPIServerVnetIntegrationPreview")
+	}
+	for _, name := range features {
+		feature := struct {
+			Properties struct {
+				State string `json:"state"`
+			} `json:"properties"`
+		}{}
+		featureID := fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Features/providers/Microsoft.ContainerService/features/%s", subscriptionID, name)
+		if err := d.getResource(featuresAPIVersion, featureID, &feature); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to get feature Microsoft.ContainerService/%s: %v", name, err))
+			continue
+		}
+		if feature.Properties.State != "Registered" {
+			problems = append(problems, fmt.Sprintf("feature Microsoft.ContainerService/%s is %s, register it with: az feature register --namespace Microsoft.ContainerService -n %s", name, feature.Properties.State, name))
+		}
+	}
+	return problems
+}
+
+// renderedClusterConfig returns the cluster template rendered for the deployer's cluster.
+func (d *deployer) renderedClusterConfig() (map[string]interface{}, error) {
+	clusterID := d.clusterResourceID()
+	clusterConfig, err := d.prepareClusterConfig(d.CCMImageTag, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(clusterConfig), &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cluster config: %v", err)
+	}
+	return config, nil
+}
+
+// agentPools returns the VM size and initial count of the agent pools of the template.
+func (d *deployer) agentPools() (map[string]int, error) {
+	config, err := d.renderedClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	properties, _ := config["properties"].(map[string]interface{})
+	return agentPoolCounts(properties), nil
+}
+
+// agentPoolCounts returns the initial count of VMs by size in the agent pool profiles.
+func agentPoolCounts(properties map[string]interface{}) map[string]int {
+	vmCounts := map[string]int{}
+	for _, p := range asList(properties["agentPoolProfiles"]) {
+		pool, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		count, _ := pool["count"].(float64)
+		vmCounts[fmt.Sprint(pool["vmSize"])] += int(count)
+	}
+	return vmCounts
+}
+
+// preflightQuota checks the VM sizes of the clusters in the location are available
+// and their vCPUs fit in the regional and family quotas.
+func (d *deployer) preflightQuota(location string, clusters []*deployer) []string {
+	var problems []string
+	vmCounts := map[string]int{}
+	for _, c := range clusters {
+		counts, err := c.agentPools()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("failed to read agent pools of cluster %q: %v", c.ClusterName, err))
+			continue
+		}
+		for size, count := range counts {
+			vmCounts[size] += count
+		}
+	}
+
+	skus := struct {
+		Value []vmSku `json:"value"`
+	}{}
+	if err := d.getResource(resourceSkusAPIVersion, fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Compute/skus", subscriptionID), &skus,
+		autorest.WithQueryParameters(map[string]interface{}{"$filter": fmt.Sprintf("location eq '%s'", location)})); err != nil {
+		return append(problems, fmt.Sprintf("failed to list VM sizes in location %q: %v", location, err))
+	}
+	usages := struct {
+		Value []computeUsage `json:"value"`
+	}{}
+	if err := d.getResource(computeAPIVersion, fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Compute/locations/%s/usages", subscriptionID, location), &usages); err != nil {
+		return append(problems, fmt.Sprintf("failed to get compute usages in location %q: %v", location, err))
+	}
+	available := map[string]int{}
+	for _, usage := range usages.Value {
+		available[strings.ToLower(usage.Name.Value)] = usage.Limit - usage.CurrentValue
+	}
+
+	required := map[string]int{}
+	for size, count := range vmCounts {
+		var sku *vmSku
+		for i := range skus.Value {
+			if skus.Value[i].ResourceType == "virtualMachines" && strings.EqualFold(skus.Value[i].Name, size) {
+				sku = &skus.Value[i]
+				break
+			}
+		}
+		if sku == nil {
+			problems = append(problems, fmt.Sprintf("VM size %s is not offered in location %q", size, location))
+			continue
+		}
+		for _, restriction := range sku.Restrictions {
+			problems = append(problems, fmt.Sprintf("VM size %s is restricted in location %q: %s", size, location, restriction.ReasonCode))
+		}
+		vCPUs := 0
+		for _, capability := range sku.Capabilities {
+			if capability.Name == "vCPUs" {
+				vCPUs, _ = strconv.Atoi(capability.Value)
+			}
+		}
+		required["cores"] += vCPUs * count
+		required[strings.ToLower(sku.Family)] += vCPUs * count
+	}
+	for quota, cores := range required {
+		if left, ok := available[quota]; ok && cores > left {
+			problems = append(problems, fmt.Sprintf("%d vCPUs of quota %q are needed in location %q but %d are left", cores, quota, location, left))
+		}
+	}
+	return problems
+}
+
+// preflightKubernetesVersions checks the Kubernetes versions of the clusters resolve
+// in the location, without changing them: Up resolves them again in the location it
+// ends up in.
+func (d *deployer) preflightKubernetesVersions(location string, clusters []*deployer) []string {
+	l := *d
+	l.Location = location
+	profiles, err := l.listKubernetesVersions()
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list Kubernetes versions in location %q: %v", location, err)}
+	}
+	var problems []string
+	for _, c := range clusters {
+		resolved, err := resolveK8sVersion(c.K8sVersion, profiles, c.K8sVersionPreview)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Kubernetes version %q of cluster %q does not resolve in location %q: %v", c.K8sVersion, c.ClusterName, location, err))
+			continue
+		}
+		klog.Infof("Preflight: Kubernetes version %q of cluster %q resolves to %q in location %q", c.K8sVersion, c.ClusterName, resolved, location)
+	}
+	return problems
+}
+
+// preflightLocation checks the Kubernetes versions and the quota of the clusters in the location.
+func (d *deployer) preflightLocation(location string, clusters []*deployer) []string {
+	problems := d.preflightKubernetesVersions(location, clusters)
+	return append(problems, d.preflightQuota(location, clusters)...)
+}
+
+// preflightFallbackLocations checks the clusters following --location in it and in
+// the fallback locations, in the order Up tries them. It only fails if none of the
+// locations fits the clusters.
+func (d *deployer) preflightFallbackLocations(clusters []*deployer) []string {
+	var problems []string
+	for _, location := range d.upLocations() {
+		locationProblems := d.preflightLocation(location, clusters)
+		if len(locationProblems) == 0 {
+			if location != d.Location {
+				klog.Warningf("Preflight: Up is expected to fall back to location %q", location)
+			}
+			return nil
+		}
+		for _, problem := range locationProblems {
+			klog.Warningf("Preflight: %s", problem)
+		}
+		problems = append(problems, locationProblems...)
+	}
+	return problems
+}
+
+// parseImageReference splits an image into the host of its registry, its repository
+// and its tag, like docker does.
+func parseImageReference(image string) (string, string, string, error) {
+	name, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+	host, repository := dockerHubRegistry, name
+	if i := strings.Index(name, "/"); i >= 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		host, repository = name[:i], name[i+1:]
+	} else if !strings.Contains(name, "/") {
+		repository = "library/" + name
+	}
+	if repository == "" || tag == "" {
+		return "", "", "", fmt.Errorf("image %q is invalid", image)
+	}
+	return host, repository, tag, nil
+}
+
+// imageManifestStatus returns the status of getting the manifest of the image from
+// its registry with the registry API, authenticated anonymously like a pull.
+func (d *deployer) imageManifestStatus(image string) (int, error) {
+	host, repository, tag, err := parseImageReference(image)
+	if err != nil {
+		return 0, err
+	}
+	client := &http.Client{Timeout: registryTimeout}
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repository, tag)
+	head := func(token string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(d.ctx, http.MethodHead, manifestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp, nil
+	}
+
+	resp, err := head("")
+	if err != nil {
+		return 0, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(challenge, "Bearer ") {
+		return resp.StatusCode, nil
+	}
+
+	// Get an anonymous pull token from the realm of the challenge
+	params := map[string]string{}
+	for _, match := range bearerChallengeRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return 0, fmt.Errorf("registry %s has an invalid authentication challenge %q", host, challenge)
+	}
+	query := tokenURL.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", repository))
+	tokenURL.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	tokenResp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer tokenResp.Body.Close()
+	if tokenResp.StatusCode != http.StatusOK {
+		return tokenResp.StatusCode, nil
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(tokenResp.Body).Decode(&token); err != nil {
+		return 0, fmt.Errorf("failed to decode token of registry %s: %v", host, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	addSecretValue(token.Token)
+	resp, err = head(token.Token)
+	if err != nil {
+		return 0, err
+	}
+	return resp.StatusCode, nil
+}
+
+// preflightImages checks the CCM and CNM images used by the custom configuration exist.
+// Images which cannot be pulled anonymously are not checked.
+func (d *deployer) preflightImages() []string {
+	customConfig, err := ioutil.ReadFile(d.CustomConfigPath)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to read custom config file at %q: %v", d.CustomConfigPath, err)}
+	}
+	var problems []string
+	for placeholder, image := range map[string]string{
+		"{CUSTOM_CCM_IMAGE}": cloudControllerManagerImage(d.CCMImageTag),
+		"{CUSTOM_CNM_IMAGE}": cloudNodeManagerImage(d.CCMImageTag),
+	} {
+		if !bytes.Contains(customConfig, []byte(placeholder)) {
+			continue
+		}
+		status, err := d.imageManifestStatus(image)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("failed to check image %s: %v", image, redactText(err.Error())))
+		case status == http.StatusOK:
+		case status == http.StatusNotFound:
+			problems = append(problems, fmt.Sprintf("image %s does not exist", image))
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			klog.Warningf("Preflight: image %s cannot be pulled anonymously, not checking it", image)
+		default:
+			problems = append(problems, fmt.Sprintf("failed to check image %s: status %d", image, status))
+		}
+	}
+	return problems
+}
+
+// preflight checks what is known to fail Up late, before anything is created, and
+// reports all the problems at once.
+func (d *deployer) preflight(cred *azidentity.DefaultAzureCredential, clusters []*deployer) error {
+	klog.Infof("Running preflight checks")
+	if _, err := cred.GetToken(d.ctx, policy.TokenRequestOptions{Scopes: []string{"https://management.azure.com/.default"}}); err != nil {
+		return fmt.Errorf("preflight failed: credential is invalid: %v", err)
+	}
+
+	problems := d.preflightNames(clusters)
+	problems = append(problems, d.preflightSubscription(cred)...)
+	problems = append(problems, d.preflightImages()...)
+
+	// Clusters following --location are checked in it and in the fallback locations
+	byLocation := map[string][]*deployer{}
+	for _, c := range clusters {
+		byLocation[c.Location] = append(byLocation[c.Location], c)
+	}
+	for location, locationClusters := range byLocation {
+		if location == d.Location {
+			problems = append(problems, d.preflightFallbackLocations(locationClusters)...)
+			continue
+		}
+		problems = append(problems, d.preflightLocation(location, locationClusters)...)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("preflight found %d problems:\n- %s", len(problems), strings.Join(problems, "\n- "))
+	}
+	klog.Infof("Preflight checks passed")
+	return nil
+}
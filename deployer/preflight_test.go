@@ -0,0 +1,55 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	testCases := []struct {
+		image      string
+		host       string
+		repository string
+		tag        string
+		err        bool
+	}{
+		{image: "mcr.microsoft.com/oss/kubernetes/azure-cloud-controller-manager:v1.24.4", host: "mcr.microsoft.com", repository: "oss/kubernetes/azure-cloud-controller-manager", tag: "v1.24.4"},
+		{image: "localhost:5000/ccm:dev", host: "localhost:5000", repository: "ccm", tag: "dev"},
+		{image: "localhost/ccm", host: "localhost", repository: "ccm", tag: "latest"},
+		{image: "user/ccm:dev", host: dockerHubRegistry, repository: "user/ccm", tag: "dev"},
+		{image: "busybox", host: dockerHubRegistry, repository: "library/busybox", tag: "latest"},
+		{image: "registry.example.com/ccm:", err: true},
+		{image: "registry.example.com/", err: true},
+	}
+	for _, tc := range testCases {
+		host, repository, tag, err := parseImageReference(tc.image)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseImageReference(%q) = %q, %q, %q, expected an error", tc.image, host, repository, tag)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseImageReference(%q) failed: %v", tc.image, err)
+			continue
+		}
+		if host != tc.host || repository != tc.repository || tag != tc.tag {
+			t.Errorf("parseImageReference(%q) = %q, %q, %q, expected %q, %q, %q", tc.image, host, repository, tag, tc.host, tc.repository, tc.tag)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	armcontainerservicev2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v2"
+	"github.com/Azure/go-autorest/autorest/to"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/kubetest2/pkg/exec"
+)
+
+const (
+	privateAccessCommandInvoke = "commandInvoke"
+	privateAccessJumpVM        = "jumpVM"
+)
+
+var (
+	computeAPIVersion = "2022-03-01"
+
+	jumpVMAdminUsername = "azureuser"
+	jumpVMSize          = "Standard_B2s"
+	jumpVMProxyPort     = 1080
+)
+
+func (d *deployer) verifyPrivateFlags() error {
+	if !d.Private {
+		if d.APIServerVnetIntegration || d.PrivateAccess != "" {
+			return fmt.Errorf("--apiServerVnetIntegration and --privateAccess require --private")
+		}
+		return nil
+	}
+	switch d.PrivateAccess {
+	case "":
+		d.PrivateAccess = privateAccessCommandInvoke
+	case privateAccessCommandInvoke:
+	case privateAccessJumpVM:
+		if d.NetworkSpecPath == "" && d.VnetCIDR == "" {
+			return fmt.Errorf("%s access requires a customer virtual network, set --vnetCIDR or --networkSpec", privateAccessJumpVM)
+		}
+		// SSH to the jump VM is never open to the internet
+		if d.JumpSourcePrefix == "" {
+			return fmt.Errorf("%s access requires --jumpSourcePrefix, the address prefix allowed to SSH to the jump VM", privateAccessJumpVM)
+		}
+		if _, err := jumpSourcePrefix(d.JumpSourcePrefix); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("private access method %q not supported", d.PrivateAccess)
+	}
+	if d.JumpSourcePrefix != "" && d.PrivateAccess != privateAccessJumpVM {
+		return fmt.Errorf("--jumpSourcePrefix requires --privateAccess %s", privateAccessJumpVM)
+	}
+	return nil
+}
+
+// jumpSourcePrefix returns the address prefix allowed to SSH to the jump VM, an IP
+// being a prefix of its own.
+func jumpSourcePrefix(prefix string) (string, error) {
+	if _, _, err := net.ParseCIDR(prefix); err == nil {
+		return prefix, nil
+	}
+	ip := net.ParseIP(prefix)
+	if ip == nil {
+		return "", fmt.Errorf("--jumpSourcePrefix %q is neither an IP nor a CIDR", prefix)
+	}
+	if ip.To4() == nil {
+		return ip.String() + "/128", nil
+	}
+	return ip.String() + "/32", nil
+}
+
+// applyPrivateCluster enables the private API server in the cluster config.
+func (d *deployer) applyPrivateCluster(clusterConfig interface{}) error {
+	if !d.Private {
+		return nil
+	}
+	config, ok := clusterConfig.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("cluster config is not a JSON object")
+	}
+	properties, ok := config["properties"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("cluster config has no properties")
+	}
+	accessProfile, ok := properties["apiServerAccessProfile"].(map[string]interface{})
+	if !ok {
+		accessProfile = map[string]interface{}{}
+		properties["apiServerAccessProfile"] = accessProfile
+	}
+	accessProfile["enablePrivateCluster"] = true
+	if d.APIServerVnetIntegration {
+		accessProfile["enableVnetIntegration"] = true
+	}
+	return nil
+}
+
+// runCommandInvoke runs a command in the cluster with the AKS command invoke API
+// and returns its logs. It works without network access to the API server.
+func (d *deployer) runCommandInvoke(cred *azidentity.DefaultAzureCredential, command string) (string, error) {
+	client, err := armcontainerservicev2.NewManagedClustersClient(subscriptionID, cred, d.armClientOptions())
+	if err != nil {
+		return "", fmt.Errorf("failed to new managed cluster client with sub ID %q: %v", subscriptionID, err)
+	}
+
+	poller, err := client.BeginRunCommand(d.ctx, d.ResourceGroupName, d.ClusterName, armcontainerservicev2.RunCommandRequest{
+		Command: to.StringPtr(command),
+	}, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin running command %q: %v", command, err)
+	}
+	resp, err := poller.PollUntilDone(d.ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to poll until command %q is done: %v", command, err)
+	}
+
+	props := resp.RunCommandResult.Properties
+	if props == nil {
+		return "", fmt.Errorf("command %q returned no result", command)
+	}
+	logs := to.String(props.Logs)
+	if props.ExitCode != nil && *props.ExitCode != 0 {
+		return logs, fmt.Errorf("command %q exited with code %d: %s", command, *props.ExitCode, to.String(props.Reason))
+	}
+	return logs, nil
+}
+
+// newSSHKey generates an SSH key pair, writes the private key to path and
+// returns the public key in authorized_keys format.
+func newSSHKey(path string) (string, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate private key: %v", err)
+	}
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to mkdir for private key: %v", err)
+	}
+	if err := ioutil.WriteFile(path, privateKeyPEM, 0600); err != nil {
+		return "", fmt.Errorf("failed to write private key to %s: %v", path, err)
+	}
+
+	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate public key: %v", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), nil
+}
+
+// createJumpVM creates a VM with a public IP in the first subnet of the customer
+// virtual network, from which the private API server is reachable.
+func (d *deployer) createJumpVM() (*jumpVMAccess, error) {
+	if d.networkSpec == nil {
+		return nil, fmt.Errorf("customer virtual network is not created")
+	}
+	name := fmt.Sprintf("%s-jumpvm", d.ClusterName)
+	klog.Infof("Creating jump VM %q", name)
+
+	privateKeyPath, err := filepath.Abs(filepath.Join(defaultKubeconfigDir, fmt.Sprintf("%s_%s.jumpvm.key", d.ResourceGroupName, d.ClusterName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get private key path: %v", err)
+	}
+	publicKey, err := newSSHKey(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH key: %v", err)
+	}
+
+	// Only the deployer may SSH to the VM, which holds the cluster credentials
+	sourcePrefix, err := jumpSourcePrefix(d.JumpSourcePrefix)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Allowing SSH to jump VM %q from %s", name, sourcePrefix)
+	sshRule := map[string]interface{}{
+		"protocol":                 "Tcp",
+		"sourcePortRange":          "*",
+		"destinationPortRange":     "22",
+		"sourceAddressPrefix":      sourcePrefix,
+		"destinationAddressPrefix": "*",
+		"access":                   "Allow",
+		"priority":                 100,
+		"direction":                "Inbound",
+	}
+	// A standard public IP is closed to inbound traffic without a security group
+	securityGroupID := d.networkResourceID("networkSecurityGroups", name)
+	if err := d.putResource(networkAPIVersion, securityGroupID, map[string]interface{}{
+		"location": d.Location,
+		"properties": map[string]interface{}{
+			"securityRules": []interface{}{
+				map[string]interface{}{"name": "allow-ssh-jumpvm", "properties": sshRule},
+			},
+		},
+	}, nil); err != nil {
+		return nil, fmt.Errorf("failed to create network security group of the jump VM: %v", err)
+	}
+	// Traffic must also be allowed by the security group of the subnet
+	if d.networkSpec.SecurityGroupName != "" {
+		ruleID := fmt.Sprintf("%s/securityRules/allow-ssh-jumpvm", d.networkResourceID("networkSecurityGroups", d.networkSpec.SecurityGroupName))
+		if err := d.putResource(networkAPIVersion, ruleID, map[string]interface{}{"properties": sshRule}, nil); err != nil {
+			return nil, fmt.Errorf("failed to allow SSH to the jump VM: %v", err)
+		}
+	}
+
+	publicIPID := d.networkResourceID("publicIPAddresses", name)
+	publicIP := struct {
+		Properties struct {
+			IPAddress string `json:"ipAddress"`
+		} `json:"properties"`
+	}{}
+	if err := d.putResource(networkAPIVersion, publicIPID, map[string]interface{}{
+		"location":   d.Location,
+		"sku":        map[string]interface{}{"name": "Standard"},
+		"properties": map[string]interface{}{"publicIPAllocationMethod": "Static"},
+	}, &publicIP); err != nil {
+		return nil, fmt.Errorf("failed to create public IP: %v", err)
+	}
+
+	nicID := d.networkResourceID("networkInterfaces", name)
+	if err := d.putResource(networkAPIVersion, nicID, map[string]interface{}{
+		"location": d.Location,
+		"properties": map[string]interface{}{
+			"networkSecurityGroup": map[string]interface{}{"id": securityGroupID},
+			"ipConfigurations": []interface{}{
+				map[string]interface{}{
+					"name": "ipconfig1",
+					"properties": map[string]interface{}{
+						"subnet":          map[string]interface{}{"id": d.subnetIDs[d.networkSpec.Subnets[0].Name]},
+						"publicIPAddress": map[string]interface{}{"id": publicIPID},
+					},
+				},
+			},
+		},
+	}, nil); err != nil {
+		return nil, fmt.Errorf("failed to create network interface: %v", err)
+	}
+
+	vmID := fmt.Sprintf("%s/providers/Microsoft.Compute/virtualMachines/%s", d.resourceGroupScope(), name)
+	if err := d.putResource(computeAPIVersion, vmID, map[string]interface{}{
+		"location": d.Location,
+		"properties": map[string]interface{}{
+			"hardwareProfile": map[string]interface{}{"vmSize": jumpVMSize},
+			"storageProfile": map[string]interface{}{
+				"imageReference": map[string]interface{}{
+					"publisher": "Canonical",
+					"offer":     "0001-com-ubuntu-server-jammy",
+					"sku":       "22_04-lts-gen2",
+					"version":   "latest",
+				},
+				"osDisk": map[string]interface{}{
+					"createOption": "FromImage",
+					"deleteOption": "Delete",
+				},
+			},
+			"osProfile": map[string]interface{}{
+				"computerName":  name,
+				"adminUsername": jumpVMAdminUsername,
+				"linuxConfiguration": map[string]interface{}{
+					"disablePasswordAuthentication": true,
+					"ssh": map[string]interface{}{
+						"publicKeys": []interface{}{
+							map[string]interface{}{
+								"path":    fmt.Sprintf("/home/%s/.ssh/authorized_keys", jumpVMAdminUsername),
+								"keyData": publicKey,
+							},
+						},
+					},
+				},
+			},
+			"networkProfile": map[string]interface{}{
+				"networkInterfaces": []interface{}{
+					map[string]interface{}{"id": nicID},
+				},
+			},
+		},
+	}, nil); err != nil {
+		return nil, fmt.Errorf("failed to create virtual machine: %v", err)
+	}
+
+	klog.Infof("Jump VM %q with public IP %q is created", name, publicIP.Properties.IPAddress)
+	return &jumpVMAccess{
+		PublicIP:       publicIP.Properties.IPAddress,
+		AdminUsername:  jumpVMAdminUsername,
+		PrivateKeyPath: privateKeyPath,
+		TunnelCommand: fmt.Sprintf("ssh -i %s -o StrictHostKeyChecking=no -N -D %d %s@%s",
+			privateKeyPath, jumpVMProxyPort, jumpVMAdminUsername, publicIP.Properties.IPAddress),
+	}, nil
+}
+
+// writeProxyKubeconfig copies the kubeconfig with every cluster going through the
+// SOCKS5 proxy opened by the jump VM tunnel.
+func (d *deployer) writeProxyKubeconfig(kubeconfigPath string) (string, error) {
+	data, err := ioutil.ReadFile(kubeconfigPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read kubeconfig %q: %v", kubeconfigPath, err)
+	}
+	proxyKubeconfigPath := strings.TrimSuffix(kubeconfigPath, ".kubeconfig") + ".proxy.kubeconfig"
+	if err := writePrivateFile(proxyKubeconfigPath, data); err != nil {
+		return "", fmt.Errorf("failed to write kubeconfig to %s", proxyKubeconfigPath)
+	}
+
+	clusters, err := cmdOutput(exec.CommandContext(d.ctx, "kubectl", "config", "get-clusters", "--kubeconfig", proxyKubeconfigPath))
+	if err != nil {
+		return "", fmt.Errorf("failed to get clusters from kubeconfig: %v", err)
+	}
+	// The first line is the NAME header
+	for _, cluster := range strings.Split(strings.TrimSpace(string(clusters)), "\n")[1:] {
+		if err := runCmd(exec.CommandContext(d.ctx, "kubectl", "config", "set-cluster", cluster, "--kubeconfig", proxyKubeconfigPath,
+			fmt.Sprintf("--proxy-url=socks5://127.0.0.1:%d", jumpVMProxyPort))); err != nil {
+			return "", fmt.Errorf("failed to set proxy URL for cluster %q: %v", cluster, err)
+		}
+	}
+	return proxyKubeconfigPath, nil
+}
+
+// privateKubeconfig returns the kubeconfig reaching the private API server recorded
+// in the state, and whether the clusters are private. Only a single cluster behind a
+// jump VM has one, the tunnels of several jump VMs using the same local port.
+func (d *deployer) privateKubeconfig(state *runState) (string, bool, error) {
+	var instructions []string
+	for _, cluster := range state.Clusters {
+		access := cluster.APIServerAccess
+		if access == nil || access.Method == "public" {
+			continue
+		}
+		if access.JumpVM != nil && len(state.Clusters) == 1 {
+			return access.JumpVM.ProxyKubeconfig, true, nil
+		}
+		instructions = append(instructions, fmt.Sprintf("cluster %q: %s", cluster.ClusterName, access.Instructions))
+	}
+	if len(instructions) == 0 {
+		return "", false, nil
+	}
+	return "", true, fmt.Errorf("the API servers are private and have no kubeconfig reachable from here, see apiServerAccess in %s:\n%s",
+		d.stateFilePath(), strings.Join(instructions, "\n"))
+}
+
+// setupAPIServerAccess provisions the path testers use to reach the API server
+// of a private cluster and documents it in the state file.
+func (d *deployer) setupAPIServerAccess(cred *azidentity.DefaultAzureCredential) error {
+	access := &apiServerAccess{
+		Method:       "public",
+		Instructions: fmt.Sprintf("Use the kubeconfig at %s", d.clusterKubeconfigPath()),
+	}
+
+	if d.Private {
+		client, err := armcontainerservicev2.NewManagedClustersClient(subscriptionID, cred, d.armClientOptions())
+		if err != nil {
+			return fmt.Errorf("failed to new managed cluster client with sub ID %q: %v", subscriptionID, err)
+		}
+		managedCluster, err := client.Get(d.ctx, d.ResourceGroupName, d.ClusterName, nil)
+		if err != nil {
+			return fmt.Errorf("failed to get managed cluster %q: %v", d.ClusterName, err)
+		}
+		if managedCluster.Properties != nil {
+			access.FQDN = to.String(managedCluster.Properties.PrivateFQDN)
+		}
+
+		switch d.PrivateAccess {
+		case privateAccessCommandInvoke:
+			output, err := d.runCommandInvoke(cred, "kubectl get nodes")
+			if err != nil {
+				return fmt.Errorf("failed to reach the API server with command invoke: %v", err)
+			}
+			klog.Infof("API server is reachable with command invoke:\n%s", output)
+			access.Method = privateAccessCommandInvoke
+			access.Instructions = fmt.Sprintf("The API server is private. Run commands with: az aks command invoke -g %s -n %s --command \"kubectl get nodes\"", d.ResourceGroupName, d.ClusterName)
+		case privateAccessJumpVM:
+			jumpVM, err := d.createJumpVM()
+			if err != nil {
+				return fmt.Errorf("failed to create jump VM: %v", err)
+			}
+			if jumpVM.ProxyKubeconfig, err = d.writeProxyKubeconfig(d.clusterKubeconfigPath()); err != nil {
+				return fmt.Errorf("failed to write proxy kubeconfig: %v", err)
+			}
+			access.Method = privateAccessJumpVM
+			access.JumpVM = jumpVM
+			access.Instructions = fmt.Sprintf("The API server is private. Open the tunnel with %q, then use the kubeconfig at %s", jumpVM.TunnelCommand, jumpVM.ProxyKubeconfig)
+		}
+	}
+
+	klog.Infof("API server access: %s", access.Instructions)
+	return d.updateClusterState(func(cluster *clusterState) {
+		cluster.APIServerAccess = access
+	})
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/kubetest2/pkg/exec"
+)
+
+var (
+	defaultReadinessTimeout = 15 * time.Minute
+
+	// ccmNodeLabels are set by the cloud node controller of CCM when it initializes a node.
+	ccmNodeLabels = []string{
+		"node.kubernetes.io/instance-type",
+		"topology.kubernetes.io/region",
+		"topology.kubernetes.io/zone",
+	}
+	uninitializedTaint = "node.cloudprovider.kubernetes.io/uninitialized"
+)
+
+// kubectlOutput runs kubectl against the cluster. Private clusters are reached
+// with the AKS command invoke API.
+func (d *deployer) kubectlOutput(cred *azidentity.DefaultAzureCredential, args ...string) ([]byte, error) {
+	if d.Private {
+		output, err := d.runCommandInvoke(cred, "kubectl "+strings.Join(args, " "))
+		return []byte(output), err
+	}
+	args = append([]string{"--kubeconfig", d.clusterKubeconfigPath()}, args...)
+	return cmdOutput(exec.CommandContext(d.ctx, "kubectl", args...))
+}
+
+// checkClusterReadiness returns the problems preventing the cluster from being ready.
+func (d *deployer) checkClusterReadiness(cred *azidentity.DefaultAzureCredential, cnmImage string) ([]string, error) {
+	var problems []string
+
+	output, err := d.kubectlOutput(cred, "get", "nodes", "-o", "json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %v", err)
+	}
+	nodes := corev1.NodeList{}
+	if err := json.Unmarshal(output, &nodes); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal nodes: %v", err)
+	}
+	if len(nodes.Items) == 0 {
+		problems = append(problems, "no node is registered")
+	}
+	for _, node := range nodes.Items {
+		ready := false
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == corev1.NodeReady {
+				ready = condition.Status == corev1.ConditionTrue
+				if !ready {
+					problems = append(problems, fmt.Sprintf("node %q is not Ready: %s %s", node.Name, condition.Reason, condition.Message))
+				}
+			}
+		}
+		if !ready && len(node.Status.Conditions) == 0 {
+			problems = append(problems, fmt.Sprintf("node %q has no Ready condition", node.Name))
+		}
+		if !strings.HasPrefix(node.Spec.ProviderID, "azure://") {
+			problems = append(problems, fmt.Sprintf("node %q has no Azure providerID: %q", node.Name, node.Spec.ProviderID))
+		}
+		for _, label := range ccmNodeLabels {
+			if _, ok := node.Labels[label]; !ok {
+				problems = append(problems, fmt.Sprintf("node %q has no label %q", node.Name, label))
+			}
+		}
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == uninitializedTaint {
+				problems = append(problems, fmt.Sprintf("node %q is not initialized by cloud-controller-manager", node.Name))
+			}
+		}
+	}
+
+	if cnmImage == "" {
+		return problems, nil
+	}
+	output, err = d.kubectlOutput(cred, "get", "pods", "-n", "kube-system", "-o", "json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pods: %v", err)
+	}
+	pods := corev1.PodList{}
+	if err := json.Unmarshal(output, &pods); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pods: %v", err)
+	}
+	cnmNodes := map[string]bool{}
+	for _, pod := range pods.Items {
+		if !strings.HasPrefix(pod.Name, "cloud-node-manager") {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			if container.Name == "cloud-node-manager" && container.Image != cnmImage {
+				problems = append(problems, fmt.Sprintf("pod %q runs image %q instead of %q", pod.Name, container.Image, cnmImage))
+			}
+		}
+		if pod.Status.Phase != corev1.PodRunning {
+			problems = append(problems, fmt.Sprintf("pod %q is %s", pod.Name, pod.Status.Phase))
+			continue
+		}
+		cnmNodes[pod.Spec.NodeName] = true
+	}
+	for _, node := range nodes.Items {
+		if !cnmNodes[node.Name] {
+			problems = append(problems, fmt.Sprintf("no running cloud-node-manager pod on node %q", node.Name))
+		}
+	}
+	return problems, nil
+}
+
+// collectReadinessDiagnostics describes the nodes and the cloud-node-manager pods.
+func (d *deployer) collectReadinessDiagnostics(cred *azidentity.DefaultAzureCredential) string {
+	var buf bytes.Buffer
+	for _, args := range [][]string{
+		{"get", "nodes", "-o", "wide", "--show-labels"},
+		{"describe", "nodes"},
+		{"get", "pods", "-n", "kube-system", "-o", "wide"},
+		{"describe", "pods", "-n", "kube-system", "-l", "k8s-app=cloud-node-manager"},
+	} {
+		fmt.Fprintf(&buf, "$ kubectl %s\n", strings.Join(args, " "))
+		output, err := d.kubectlOutput(cred, args...)
+		if err != nil {
+			fmt.Fprintf(&buf, "error: %v\n", err)
+		}
+		buf.Write(output)
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// waitForClusterReadiness waits until every node is Ready and initialized by CCM, and
+// cloud-node-manager runs the image built for the run on every node.
+func (d *deployer) waitForClusterReadiness(cred *azidentity.DefaultAzureCredential) error {
+	cnmImage := ""
+	customConfig, err := ioutil.ReadFile(d.CustomConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to read custom config file at %q: %v", d.CustomConfigPath, err)
+	}
+	if bytes.Contains(customConfig, []byte("{CUSTOM_CNM_IMAGE}")) {
+		cnmImage = cloudNodeManagerImage(d.CCMImageTag)
+	}
+
+	klog.Infof("Waiting up to %s for cluster %q to be ready", d.ReadinessTimeout, d.ClusterName)
+	var problems []string
+	err = wait.PollImmediateWithContext(d.ctx, 30*time.Second, d.ReadinessTimeout, func(ctx context.Context) (done bool, err error) {
+		problems, err = d.checkClusterReadiness(cred, cnmImage)
+		if err != nil {
+			klog.Infof("failed to check readiness of cluster %q, retrying: %v", d.ClusterName, err)
+			problems = []string{err.Error()}
+			return false, nil
+		}
+		if len(problems) > 0 {
+			klog.Infof("Cluster %q is not ready yet: %s", d.ClusterName, strings.Join(problems, "; "))
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		diagnostics := fmt.Sprintf("%s\n\n%s", strings.Join(problems, "\n"), d.collectReadinessDiagnostics(cred))
+		klog.Errorf("Cluster %q is not ready:\n%s", d.ClusterName, diagnostics)
+		diagnosticsPath := filepath.Join(d.clusterLogsDir(), "readiness-diagnostics.txt")
+		if err := os.MkdirAll(d.clusterLogsDir(), os.ModePerm); err == nil {
+			if err := ioutil.WriteFile(diagnosticsPath, []byte(redactText(diagnostics)), 0644); err != nil {
+				klog.Errorf("failed to write readiness diagnostics to %s: %v", diagnosticsPath, err)
+			}
+		}
+		return fmt.Errorf("cluster %q is not ready after %s, diagnostics are in %s: %s", d.ClusterName, d.ReadinessTimeout, diagnosticsPath, strings.Join(problems, "; "))
+	}
+	klog.Infof("Cluster %q is ready", d.ClusterName)
+	return nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/go-autorest/autorest"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/kubetest2/pkg/artifacts"
+)
+
+var (
+	armTrafficFileName = "arm-traffic.jsonl"
+
+	// armTrafficLock serializes writes of ARM traffic records by concurrent requests.
+	armTrafficLock sync.Mutex
+)
+
+// armTrafficRecord is one ARM request and its response, with secrets redacted.
+type armTrafficRecord struct {
+	Time            time.Time         `json:"time"`
+	Phase           string            `json:"phase,omitempty"`
+	Method          string            `json:"method"`
+	URL             string            `json:"url"`
+	StatusCode      int               `json:"statusCode,omitempty"`
+	DurationMs      int64             `json:"durationMs"`
+	CorrelationID   string            `json:"correlationID,omitempty"`
+	RequestID       string            `json:"requestID,omitempty"`
+	ClientRequestID string            `json:"clientRequestID,omitempty"`
+	RequestHeaders  map[string]string `json:"requestHeaders,omitempty"`
+	RequestBody     string            `json:"requestBody,omitempty"`
+	ResponseHeaders map[string]string `json:"responseHeaders,omitempty"`
+	ResponseBody    string            `json:"responseBody,omitempty"`
+	Error           string            `json:"error,omitempty"`
+}
+
+func armTrafficPath() string {
+	return filepath.Join(artifacts.BaseDir(), armTrafficFileName)
+}
+
+// readRequestBody returns the body of the request, leaving it readable.
+func readRequestBody(req *http.Request) []byte {
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil
+		}
+		defer body.Close()
+		data, _ := ioutil.ReadAll(body)
+		return data
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	data, _ := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data
+}
+
+// readResponseBody returns the body of the response, leaving it readable.
+func readResponseBody(resp *http.Response) []byte {
+	if resp == nil || resp.Body == nil {
+		return nil
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data
+}
+
+// recordARMTraffic appends the request and its response to the ARM traffic file.
+// Failing to record never fails the request.
+func (d *deployer) recordARMTraffic(req *http.Request, requestBody []byte, resp *http.Response, err error, start time.Time) {
+	record := armTrafficRecord{
+		Time:           start,
+		Phase:          d.phase,
+		Method:         req.Method,
+		URL:            redactURL(req.URL),
+		DurationMs:     time.Since(start).Milliseconds(),
+		RequestHeaders: redactHeaders(req.Header),
+		RequestBody:    redactBody(requestBody),
+	}
+	if resp != nil {
+		record.StatusCode = resp.StatusCode
+		record.CorrelationID = resp.Header.Get("x-ms-correlation-request-id")
+		record.RequestID = resp.Header.Get("x-ms-request-id")
+		record.ClientRequestID = resp.Header.Get("x-ms-client-request-id")
+		record.ResponseHeaders = redactHeaders(resp.Header)
+		record.ResponseBody = redactBody(readResponseBody(resp))
+	}
+	if err != nil {
+		record.Error = redactText(err.Error())
+	}
+
+	line, merr := json.Marshal(record)
+	if merr != nil {
+		klog.Warningf("failed to marshal ARM traffic record: %v", merr)
+		return
+	}
+	armTrafficLock.Lock()
+	defer armTrafficLock.Unlock()
+	if err := os.MkdirAll(artifacts.BaseDir(), os.ModePerm); err != nil {
+		klog.Warningf("failed to mkdir the artifacts dir: %v", err)
+		return
+	}
+	// Like kubeconfigs and the state file, the records are readable by the owner only
+	f, ferr := os.OpenFile(armTrafficPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if ferr != nil {
+		klog.Warningf("failed to open ARM traffic file: %v", ferr)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		klog.Warningf("failed to record ARM traffic: %v", err)
+	}
+}
+
+// armRecordingPolicy is the azcore pipeline policy recording every attempt of ARM requests.
+type armRecordingPolicy struct {
+	d *deployer
+}
+
+func (p *armRecordingPolicy) Do(req *policy.Request) (*http.Response, error) {
+	var requestBody []byte
+	if body := req.Body(); body != nil {
+		requestBody, _ = ioutil.ReadAll(body)
+		if err := req.RewindBody(); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	resp, err := req.Next()
+	p.d.recordARMTraffic(req.Raw(), requestBody, resp, err, start)
+	return resp, err
+}
+
+// withARMRecording is the autorest send decorator recording every attempt of ARM requests.
+func (d *deployer) withARMRecording() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			requestBody := readRequestBody(r)
+			start := time.Now()
+			resp, err := s.Do(r)
+			d.recordARMTraffic(r, requestBody, resp, err, start)
+			return resp, err
+		})
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"k8s.io/klog"
+	klogv2 "k8s.io/klog/v2"
+)
+
+const redacted = "REDACTED"
+
+var (
+	// secretKeys are JSON keys, compared case-insensitively, whose values are secrets.
+	secretKeys = map[string]bool{
+		"secret":        true,
+		"clientsecret":  true,
+		"password":      true,
+		"adminpassword": true,
+		"kubeconfig":    true,
+		"kubeconfigs":   true,
+		"privatekey":    true,
+		"access_token":  true,
+		"accesstoken":   true,
+		"refresh_token": true,
+		"customdata":    true,
+	}
+	// secretHeaders are HTTP headers whose values are secrets.
+	secretHeaders = []string{"Authorization", "x-ms-authorization-auxiliary"}
+	// secretQueryParameters are URL query parameters whose values are secrets, like SAS signatures.
+	secretQueryParameters = []string{"sig", "code"}
+	// secretPatterns match secrets in text output, like bearer tokens and kubeconfig credentials.
+	// The first group is kept.
+	secretPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)(\bbearer\s+)[A-Za-z0-9\-_.~+/]+=*`),
+		regexp.MustCompile(`([?&]sig=)[^&"\s]+`),
+		regexp.MustCompile(`(?i)(\b(?:client-key-data|client-certificate-data|token|password|secret|client_?secret|access_token|refresh_token)"?\s*[:=]\s*"?)[^\s",}&]+`),
+	}
+
+	// secretValues are the values of the secrets known to the deployer.
+	secretValues     []string
+	secretValuesLock sync.RWMutex
+)
+
+// addSecretValue registers a secret to be redacted from all output.
+func addSecretValue(value string) {
+	if value == "" {
+		return
+	}
+	secretValuesLock.Lock()
+	defer secretValuesLock.Unlock()
+	secretValues = append(secretValues, value)
+}
+
+// redactSecretValues replaces the values of known secrets in s.
+func redactSecretValues(s string) string {
+	secretValuesLock.RLock()
+	defer secretValuesLock.RUnlock()
+	for _, value := range secretValues {
+		s = strings.ReplaceAll(s, value, redacted)
+	}
+	return s
+}
+
+// redactText replaces known secrets and anything looking like a secret in s.
+func redactText(s string) string {
+	s = redactSecretValues(s)
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, "${1}"+redacted)
+	}
+	return s
+}
+
+// redactJSONValue replaces the values of secret keys in a decoded JSON value.
+func redactJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if secretKeys[strings.ToLower(k)] {
+				v[k] = redacted
+			} else {
+				v[k] = redactJSONValue(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactJSONValue(v[i])
+		}
+	}
+	return v
+}
+
+// redactBody redacts a request or response body, JSON or not.
+func redactBody(body []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		// Without HTML escaping, & stays a separator of query parameters in URLs
+		var b bytes.Buffer
+		encoder := json.NewEncoder(&b)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(redactJSONValue(v)); err == nil {
+			body = bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+		}
+	}
+	return redactText(string(body))
+}
+
+// redactHeaders returns the headers with secret values redacted.
+func redactHeaders(header http.Header) map[string]string {
+	headers := map[string]string{}
+	for k := range header {
+		headers[k] = redactSecretValues(header.Get(k))
+	}
+	for _, k := range secretHeaders {
+		if header.Get(k) != "" {
+			headers[http.CanonicalHeaderKey(k)] = redacted
+		}
+	}
+	return headers
+}
+
+// redactURL returns the URL with secret query parameters redacted.
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	redactedURL := *u
+	query := redactedURL.Query()
+	for _, k := range secretQueryParameters {
+		if query.Get(k) != "" {
+			query.Set(k, redacted)
+		}
+	}
+	redactedURL.RawQuery = query.Encode()
+	return redactSecretValues(redactedURL.String())
+}
+
+// redactingWriter redacts complete lines before writing them to w.
+type redactingWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+func newRedactingWriter(w io.Writer) *redactingWriter {
+	return &redactingWriter{w: w}
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.buf = append(rw.buf, p...)
+	// A secret is never split, since only complete lines are written
+	if i := bytes.LastIndexByte(rw.buf, '\n'); i >= 0 {
+		if _, err := io.WriteString(rw.w, redactText(string(rw.buf[:i+1]))); err != nil {
+			return 0, err
+		}
+		rw.buf = rw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes the incomplete last line, if any.
+func (rw *redactingWriter) Flush() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if len(rw.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(rw.w, redactText(string(rw.buf)))
+	rw.buf = nil
+	return err
+}
+
+// klogFlags stop klog from writing to stderr directly. Above FATAL, nothing is.
+var klogFlags = map[string]string{
+	"logtostderr":     "false",
+	"alsologtostderr": "false",
+	"stderrthreshold": "4",
+}
+
+// redactLogs redirects the logs of the deployer, with klog, and of its dependencies,
+// with klog/v2, to stderr through the redactor. klog writes every severity to the
+// INFO output, so the others are discarded.
+func redactLogs() {
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	fsv2 := flag.NewFlagSet("klog/v2", flag.ContinueOnError)
+	klogv2.InitFlags(fsv2)
+	for k, v := range klogFlags {
+		if err := fs.Set(k, v); err != nil {
+			klog.Warningf("failed to set klog flag %s: %v", k, err)
+			return
+		}
+		if err := fsv2.Set(k, v); err != nil {
+			klog.Warningf("failed to set klog/v2 flag %s: %v", k, err)
+			return
+		}
+	}
+	stderr := newRedactingWriter(os.Stderr)
+	klog.SetOutputBySeverity("INFO", stderr)
+	klogv2.SetOutputBySeverity("INFO", stderr)
+	for _, severity := range []string{"WARNING", "ERROR", "FATAL"} {
+		klog.SetOutputBySeverity(severity, ioutil.Discard)
+		klogv2.SetOutputBySeverity(severity, ioutil.Discard)
+	}
+}
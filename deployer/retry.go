@@ -0,0 +1,304 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/go-autorest/autorest"
+	"k8s.io/klog"
+)
+
+// armErrorClass classifies failed ARM requests.
+type armErrorClass string
+
+const (
+	armErrorNone            armErrorClass = ""
+	armErrorThrottled       armErrorClass = "Throttled"
+	armErrorTransient       armErrorClass = "Transient"
+	armErrorConflict        armErrorClass = "ConflictingOperation"
+	armErrorQuotaExceeded   armErrorClass = "QuotaExceeded"
+	armErrorCapacity        armErrorClass = "CapacityUnavailable"
+	armErrorInvalidTemplate armErrorClass = "InvalidTemplate"
+	armErrorOther           armErrorClass = "Other"
+)
+
+var (
+	defaultARMMaxRetries = 5
+	defaultARMRetryDelay = 5 * time.Second
+	maxARMRetryDelay     = 2 * time.Minute
+	// Conflicting operations usually take minutes to finish.
+	minARMConflictRetryDelay = 30 * time.Second
+
+	// armErrorCodes classifies ARM error codes. When an error has several codes, like
+	// a conflict wrapping an allocation failure, the first one listed here wins, so
+	// the errors Up falls back to another location on come first.
+	armErrorCodes = []struct {
+		code  string
+		class armErrorClass
+	}{
+		{"SkuNotAvailable", armErrorCapacity},
+		{"AllocationFailed", armErrorCapacity},
+		{"ZonalAllocationFailed", armErrorCapacity},
+		{"OverconstrainedAllocationRequest", armErrorCapacity},
+		{"QuotaExceeded", armErrorQuotaExceeded},
+		{"InsufficientVCPUQuota", armErrorQuotaExceeded},
+		{"PublicIPCountLimitReached", armErrorQuotaExceeded},
+		{"InvalidTemplate", armErrorInvalidTemplate},
+		{"InvalidTemplateDeployment", armErrorInvalidTemplate},
+		{"InvalidParameter", armErrorInvalidTemplate},
+		{"InvalidRequestContent", armErrorInvalidTemplate},
+		{"InvalidRequestFormat", armErrorInvalidTemplate},
+		{"BadRequest", armErrorInvalidTemplate},
+		{"PropertyChangeNotAllowed", armErrorInvalidTemplate},
+		{"AnotherOperationInProgress", armErrorConflict},
+		{"OperationPreempted", armErrorConflict},
+		{"RetryableError", armErrorConflict},
+	}
+
+	// armErrorCodeRegexps match the code fields of the errors of the ARM clients:
+	// Code="..." of autorest, ERROR CODE: ... of azcore and "code": "..." of JSON
+	// bodies, which may be escaped in a message.
+	armErrorCodeRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`\bCode="(\w+)"`),
+		regexp.MustCompile(`ERROR CODE: (\w+)`),
+		regexp.MustCompile(`\\?"code\\?"\s*:\s*\\?"(\w+)`),
+	}
+
+	rateLimitHeaders = []string{
+		"x-ms-ratelimit-remaining-subscription-reads",
+		"x-ms-ratelimit-remaining-subscription-writes",
+		"x-ms-ratelimit-remaining-subscription-deletes",
+		"x-ms-ratelimit-remaining-resource",
+	}
+)
+
+// retryable returns true if requests failed with this class should be retried.
+func (c armErrorClass) retryable() bool {
+	return c == armErrorThrottled || c == armErrorTransient || c == armErrorConflict
+}
+
+// locationBound returns true if another location may not fail with this class.
+func (c armErrorClass) locationBound() bool {
+	return c == armErrorCapacity || c == armErrorQuotaExceeded
+}
+
+// armErrorCode returns the error code of an ARM error response body.
+func armErrorCode(body []byte) string {
+	armError := struct {
+		Code  string `json:"code"`
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &armError); err != nil {
+		return ""
+	}
+	if armError.Error.Code != "" {
+		return armError.Error.Code
+	}
+	return armError.Code
+}
+
+// classifyARMErrorCode classifies an ARM error code, regardless of the status code.
+func classifyARMErrorCode(code string) armErrorClass {
+	for _, c := range armErrorCodes {
+		if c.code == code {
+			return c.class
+		}
+	}
+	return armErrorNone
+}
+
+// classifyARMResponse classifies the result of an ARM request. The response body
+// is read and replaced so that callers can still read it.
+func classifyARMResponse(resp *http.Response, err error) armErrorClass {
+	if resp == nil {
+		if err != nil {
+			// Connection failures
+			return armErrorTransient
+		}
+		return armErrorNone
+	}
+	if resp.StatusCode < 400 {
+		return armErrorNone
+	}
+
+	code := ""
+	if resp.Body != nil {
+		body, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if readErr == nil {
+			code = armErrorCode(body)
+		}
+	}
+	if class := classifyARMErrorCode(code); class != armErrorNone {
+		return class
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return armErrorThrottled
+	case http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return armErrorTransient
+	case http.StatusBadRequest:
+		return armErrorInvalidTemplate
+	}
+	return armErrorOther
+}
+
+// armErrorCodesOf returns the error codes in the message of an ARM error, which may
+// wrap the errors of nested operations.
+func armErrorCodesOf(message string) map[string]bool {
+	codes := map[string]bool{}
+	for _, r := range armErrorCodeRegexps {
+		for _, match := range r.FindAllStringSubmatch(message, -1) {
+			codes[match[1]] = true
+		}
+	}
+	return codes
+}
+
+// classifyARMError classifies an error returned by an ARM call by the error codes in it.
+func classifyARMError(err error) armErrorClass {
+	if err == nil {
+		return armErrorNone
+	}
+	message := err.Error()
+	codes := armErrorCodesOf(message)
+	for _, c := range armErrorCodes {
+		if codes[c.code] {
+			return c.class
+		}
+	}
+	// Exceeding a regional core quota is reported as OperationNotAllowed.
+	if codes["OperationNotAllowed"] && strings.Contains(strings.ToLower(message), "quota") {
+		return armErrorQuotaExceeded
+	}
+	return armErrorOther
+}
+
+// armRetryDelay returns the delay before the attempt, honoring Retry-After.
+func (d *deployer) armRetryDelay(resp *http.Response, class armErrorClass, attempt int) time.Duration {
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	delay := d.ARMRetryDelay << (attempt - 1)
+	if delay > maxARMRetryDelay || delay <= 0 {
+		delay = maxARMRetryDelay
+	}
+	if class == armErrorConflict && delay < minARMConflictRetryDelay {
+		delay = minARMConflictRetryDelay
+	}
+	// Jitter between 75% and 125%
+	return time.Duration(float64(delay) * (0.75 + rand.Float64()/2))
+}
+
+func rateLimitRemaining(resp *http.Response) string {
+	if resp == nil {
+		return ""
+	}
+	var remaining []string
+	for _, header := range rateLimitHeaders {
+		if v := resp.Header.Get(header); v != "" {
+			remaining = append(remaining, fmt.Sprintf("%s=%s", header, v))
+		}
+	}
+	return strings.Join(remaining, " ")
+}
+
+// sendWithARMRetry calls send until it succeeds, fails with an error that is not
+// retryable or runs out of retries. Each retry is logged with the remaining rate limits.
+func (d *deployer) sendWithARMRetry(req *http.Request, send func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := send()
+		class := classifyARMResponse(resp, err)
+		if !class.retryable() || attempt > d.ARMMaxRetries || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		delay := d.armRetryDelay(resp, class, attempt)
+		status := "no response"
+		if resp != nil {
+			status = resp.Status
+			resp.Body.Close()
+		}
+		klog.Infof("Retrying %s %s in %s (attempt %d/%d): %s error, %s %v, remaining rate limits: [%s]",
+			req.Method, req.URL.Path, delay, attempt, d.ARMMaxRetries, class, status, err, rateLimitRemaining(resp))
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// armRetryPolicy is the azcore pipeline policy retrying ARM requests by class.
+type armRetryPolicy struct {
+	d *deployer
+}
+
+func (p *armRetryPolicy) Do(req *policy.Request) (*http.Response, error) {
+	return p.d.sendWithARMRetry(req.Raw(), func() (*http.Response, error) {
+		if err := req.RewindBody(); err != nil {
+			return nil, err
+		}
+		return req.Next()
+	})
+}
+
+// armClientOptions returns the options of the Azure SDK clients. The built-in retry
+// policy is replaced by the classified one, and every attempt is recorded.
+func (d *deployer) armClientOptions() *arm.ClientOptions {
+	return &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Retry:            policy.RetryOptions{MaxRetries: -1},
+			PerCallPolicies:  []policy.Policy{&armRetryPolicy{d: d}},
+			PerRetryPolicies: []policy.Policy{&armRecordingPolicy{d: d}},
+		},
+	}
+}
+
+// withARMRetry is the autorest send decorator retrying ARM requests by class.
+func (d *deployer) withARMRetry() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			rr := autorest.NewRetriableRequest(r)
+			return d.sendWithARMRetry(r, func() (*http.Response, error) {
+				if err := rr.Prepare(); err != nil {
+					return nil, err
+				}
+				return s.Do(rr.Request())
+			})
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClassifyARMErrorCode(t *testing.T) {
+	testCases := []struct {
+		code     string
+		expected armErrorClass
+	}{
+		{code: "", expected: armErrorNone},
+		{code: "QuotaExceeded", expected: armErrorQuotaExceeded},
+		{code: "ZonalAllocationFailed", expected: armErrorCapacity},
+		{code: "SkuNotAvailable", expected: armErrorCapacity},
+		{code: "InvalidTemplateDeployment", expected: armErrorInvalidTemplate},
+		{code: "PropertyChangeNotAllowed", expected: armErrorInvalidTemplate},
+		{code: "AnotherOperationInProgress", expected: armErrorConflict},
+		{code: "ResourceNotFound", expected: armErrorNone},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.code, func(t *testing.T) {
+			if class := classifyARMErrorCode(tc.code); class != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, class)
+			}
+		})
+	}
+}
+
+func TestClassifyARMResponse(t *testing.T) {
+	testCases := []struct {
+		name     string
+		status   int
+		body     string
+		err      error
+		expected armErrorClass
+	}{
+		{name: "connection failure", err: errors.New("connection reset"), expected: armErrorTransient},
+		{name: "no response", expected: armErrorNone},
+		{name: "success", status: http.StatusOK, body: `{}`, expected: armErrorNone},
+		{name: "throttled", status: http.StatusTooManyRequests, expected: armErrorThrottled},
+		{name: "server error", status: http.StatusInternalServerError, body: `{"error": {"code": "InternalServerError"}}`, expected: armErrorTransient},
+		{name: "gateway timeout", status: http.StatusGatewayTimeout, expected: armErrorTransient},
+		{name: "bad request", status: http.StatusBadRequest, body: `not json`, expected: armErrorInvalidTemplate},
+		{name: "quota in a bad request", status: http.StatusBadRequest, body: `{"error": {"code": "QuotaExceeded"}}`, expected: armErrorQuotaExceeded},
+		{name: "top-level code", status: http.StatusConflict, body: `{"code": "AnotherOperationInProgress"}`, expected: armErrorConflict},
+		{name: "conflict without code", status: http.StatusConflict, body: `{}`, expected: armErrorOther},
+		{name: "forbidden", status: http.StatusForbidden, body: `{"error": {"code": "AuthorizationFailed"}}`, expected: armErrorOther},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var resp *http.Response
+			if tc.status != 0 {
+				resp = &http.Response{StatusCode: tc.status, Body: ioutil.NopCloser(strings.NewReader(tc.body))}
+			}
+			if class := classifyARMResponse(resp, tc.err); class != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, class)
+			}
+			if resp == nil {
+				return
+			}
+			// The body is still readable by the caller
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil || string(body) != tc.body {
+				t.Errorf("expected body %q to be readable, got %q, %v", tc.body, body, err)
+			}
+		})
+	}
+}
+
+func TestClassifyARMError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected armErrorClass
+	}{
+		{name: "nil", expected: armErrorNone},
+		{name: "regional quota", err: errors.New(`Code="OperationNotAllowed" Message="Operation could not be completed as it results in exceeding approved Total Regional Cores quota"`), expected: armErrorQuotaExceeded},
+		{name: "not allowed", err: errors.New(`Code="OperationNotAllowed" Message="Operation is not allowed"`), expected: armErrorOther},
+		{name: "allocation", err: errors.New(`Code="AllocationFailed"`), expected: armErrorCapacity},
+		{name: "quota", err: errors.New(`ERROR CODE: QuotaExceeded`), expected: armErrorQuotaExceeded},
+		{name: "conflict wrapping allocation", err: errors.New(`Code="Conflict" Message="{\"error\": {\"code\": \"OperationPreempted\", \"details\": [{\"code\": \"AllocationFailed\"}]}}"`), expected: armErrorCapacity},
+		{name: "codes in any order", err: errors.New(`{"code": "InvalidParameter", "details": [{"code": "QuotaExceeded"}]}`), expected: armErrorQuotaExceeded},
+		{name: "code in a message", err: errors.New(`Code="Conflict" Message="retry after the SkuNotAvailable period"`), expected: armErrorOther},
+		{name: "invalid parameter", err: errors.New(`Code="InvalidParameter"`), expected: armErrorInvalidTemplate},
+		{name: "conflict", err: errors.New(`Code="OperationPreempted"`), expected: armErrorConflict},
+		{name: "other", err: errors.New("context deadline exceeded"), expected: armErrorOther},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if class := classifyARMError(tc.err); class != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, class)
+			}
+		})
+	}
+}
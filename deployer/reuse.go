@@ -0,0 +1,266 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	armcontainerservicev2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v2"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/klog"
+)
+
+var (
+	// customConfigHashTag records the custom configuration a cluster was created with,
+	// since the custom configuration itself is not returned by GET.
+	customConfigHashTag = "kubetest2-aks-custom-config-hash"
+
+	// agentPoolFields are compared between the template and an existing cluster.
+	agentPoolFields = []string{"count", "vmSize", "osType", "mode"}
+)
+
+// tagCustomConfigHash tags the cluster config with the hash of its custom configuration.
+func tagCustomConfigHash(clusterConfig interface{}) error {
+	config, ok := clusterConfig.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("cluster config is not a JSON object")
+	}
+	properties, _ := config["properties"].(map[string]interface{})
+	customConfig, _ := properties["encodedCustomConfiguration"].(string)
+	if customConfig == "" {
+		return nil
+	}
+	tags, ok := config["tags"].(map[string]interface{})
+	if !ok {
+		tags = map[string]interface{}{}
+		config["tags"] = tags
+	}
+	hash := sha256.Sum256([]byte(customConfig))
+	tags[customConfigHashTag] = hex.EncodeToString(hash[:])
+	return nil
+}
+
+// getClusterResource gets the managed cluster as generic JSON, returning nil if it
+// does not exist.
+func (d *deployer) getClusterResource(clusterID string) (map[string]interface{}, error) {
+	armClient, err := d.newArmClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to new arm client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+
+	resp, rerr := armClient.GetResource(ctx, clusterID)
+	defer armClient.CloseResponse(ctx, resp)
+	if rerr != nil {
+		if rerr.HTTPStatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get cluster %q: %v", clusterID, rerr.Error())
+	}
+	cluster := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&cluster); err != nil {
+		return nil, fmt.Errorf("failed to decode cluster %q: %v", clusterID, err)
+	}
+	return cluster, nil
+}
+
+// k8sVersionMismatch returns true if the existing Kubernetes version differs from the
+// version of the template. When an alias was requested, the alias may resolve to a
+// newer patch than the cluster was created with, so only the minor versions are compared.
+func k8sVersionMismatch(requested string, want, got interface{}) bool {
+	if requested == "" || exactK8sVersion(requested) {
+		return fmt.Sprint(want) != fmt.Sprint(got)
+	}
+	wantVersion, err := version.ParseGeneric(fmt.Sprint(want))
+	if err != nil {
+		return true
+	}
+	gotVersion, err := version.ParseGeneric(fmt.Sprint(got))
+	if err != nil {
+		return true
+	}
+	return !sameMinor(wantVersion, gotVersion)
+}
+
+// clusterSpecMismatches returns how the existing cluster differs from the rendered
+// template: Kubernetes version, agent pools and custom configuration.
+func clusterSpecMismatches(template, existing map[string]interface{}, requestedK8sVersion string) []string {
+	var mismatches []string
+	templateProperties, _ := template["properties"].(map[string]interface{})
+	existingProperties, _ := existing["properties"].(map[string]interface{})
+
+	if state, _ := existingProperties["provisioningState"].(string); state != "Succeeded" {
+		mismatches = append(mismatches, fmt.Sprintf("provisioning state is %q", state))
+	}
+	if want, got := templateProperties["kubernetesVersion"], existingProperties["kubernetesVersion"]; k8sVersionMismatch(requestedK8sVersion, want, got) {
+		mismatches = append(mismatches, fmt.Sprintf("Kubernetes version is %v instead of %v", got, want))
+	}
+
+	existingPools := map[string]map[string]interface{}{}
+	for _, p := range asList(existingProperties["agentPoolProfiles"]) {
+		if pool, ok := p.(map[string]interface{}); ok {
+			existingPools[fmt.Sprint(pool["name"])] = pool
+		}
+	}
+	templatePools := asList(templateProperties["agentPoolProfiles"])
+	if len(templatePools) != len(existingPools) {
+		mismatches = append(mismatches, fmt.Sprintf("%d agent pools instead of %d", len(existingPools), len(templatePools)))
+	}
+	for _, p := range templatePools {
+		want, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name := fmt.Sprint(want["name"])
+		got, ok := existingPools[name]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("agent pool %q does not exist", name))
+			continue
+		}
+		for _, field := range agentPoolFields {
+			if _, ok := want[field]; !ok {
+				continue
+			}
+			// The autoscaler changes the count
+			if field == "count" && want["enableAutoScaling"] == true {
+				continue
+			}
+			if !strings.EqualFold(fmt.Sprint(want[field]), fmt.Sprint(got[field])) {
+				mismatches = append(mismatches, fmt.Sprintf("agent pool %q has %s %v instead of %v", name, field, got[field], want[field]))
+			}
+		}
+	}
+
+	templateTags, _ := template["tags"].(map[string]interface{})
+	existingTags, _ := existing["tags"].(map[string]interface{})
+	if want, ok := templateTags[customConfigHashTag]; ok && want != existingTags[customConfigHashTag] {
+		mismatches = append(mismatches, "custom configuration differs")
+	}
+	return mismatches
+}
+
+func asList(v interface{}) []interface{} {
+	list, _ := v.([]interface{})
+	return list
+}
+
+// reusableCluster returns true if the cluster exists and matches the rendered template,
+// and false if it does not exist. A cluster which does not match is not updated in
+// place, which may fail or leave it half-upgraded, so it is an error.
+func (d *deployer) reusableCluster(clusterID string, clusterConfig interface{}) (bool, error) {
+	existing, err := d.getClusterResource(clusterID)
+	if err != nil || existing == nil {
+		return false, err
+	}
+	template, ok := clusterConfig.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("cluster config is not a JSON object")
+	}
+	if mismatches := clusterSpecMismatches(template, existing, d.requestedK8sVersion); len(mismatches) > 0 {
+		return false, fmt.Errorf("cluster %q exists but does not match the template, delete it to create it again:\n- %s",
+			d.ClusterName, strings.Join(mismatches, "\n- "))
+	}
+	// The cloud provider tags its resources with the run ID the cluster was created with
+	existingTags, _ := existing["tags"].(map[string]interface{})
+	runID, _ := existingTags[runIDTag].(string)
+	if err := d.updateClusterState(func(cluster *clusterState) {
+		cluster.RunID = runID
+	}); err != nil {
+		return false, fmt.Errorf("failed to update state: %v", err)
+	}
+	return true, nil
+}
+
+func (d *deployer) verifyAdoptFlags() error {
+	if d.ReuseCluster {
+		return fmt.Errorf("--adopt and --reuseCluster are mutually exclusive")
+	}
+	if len(d.PostUpManifests) > 0 || len(d.PostUpHelmCharts) > 0 || d.CleanupOnFailure {
+		return fmt.Errorf("--adopt is read-only, post-Up installation and --cleanupOnFailure are not supported")
+	}
+	_, err := d.getClusterSpecs()
+	return err
+}
+
+// adoptClusters attaches to existing clusters read-only: nothing is created or
+// changed, and Down leaves them alone.
+func (d *deployer) adoptClusters(cred *azidentity.DefaultAzureCredential) error {
+	clusters, err := d.clusters()
+	if err != nil {
+		return err
+	}
+	if err := d.updateState(func(state *runState) {
+		state.ResourceGroupName = d.ResourceGroupName
+		state.Location = d.Location
+		state.Adopted = true
+	}); err != nil {
+		return fmt.Errorf("failed to update state: %v", err)
+	}
+
+	if err := forEachCluster(clusters, func(c *deployer) error {
+		return c.adoptCluster(cred)
+	}); err != nil {
+		return err
+	}
+	if err := d.mergeKubeconfigs(clusters); err != nil {
+		return fmt.Errorf("failed to merge kubeconfigs: %v", err)
+	}
+	return nil
+}
+
+func (d *deployer) adoptCluster(cred *azidentity.DefaultAzureCredential) error {
+	client, err := armcontainerservicev2.NewManagedClustersClient(subscriptionID, cred, d.armClientOptions())
+	if err != nil {
+		return fmt.Errorf("failed to new managed cluster client with sub ID %q: %v", subscriptionID, err)
+	}
+	managedCluster, err := client.Get(d.ctx, d.ResourceGroupName, d.ClusterName, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get managed cluster %q: %v", d.ClusterName, err)
+	}
+	properties := managedCluster.Properties
+	if properties == nil || to.String(properties.ProvisioningState) != "Succeeded" {
+		return fmt.Errorf("managed cluster %q is not provisioned successfully", d.ClusterName)
+	}
+	d.Location = to.String(managedCluster.Location)
+	d.K8sVersion = to.String(properties.KubernetesVersion)
+	if properties.APIServerAccessProfile != nil && to.Bool(properties.APIServerAccessProfile.EnablePrivateCluster) {
+		d.Private, d.PrivateAccess = true, privateAccessCommandInvoke
+	}
+	klog.Infof("Adopting cluster %q of Kubernetes %s in location %q", d.ClusterName, d.K8sVersion, d.Location)
+
+	if err := d.getAKSKubeconfig(cred); err != nil {
+		return fmt.Errorf("failed to get AKS cluster kubeconfig: %v", err)
+	}
+	if err := d.updateClusterState(func(cluster *clusterState) {
+		cluster.Location = d.Location
+		cluster.K8sVersion = d.K8sVersion
+		cluster.Kubeconfig = d.clusterKubeconfigPath()
+	}); err != nil {
+		return fmt.Errorf("failed to update state: %v", err)
+	}
+	return d.setupAPIServerAccess(cred)
+}
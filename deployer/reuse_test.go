@@ -0,0 +1,170 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestClusterSpecMismatches(t *testing.T) {
+	template := `{
+		"tags": {"kubetest2-aks-custom-config-hash": "abc"},
+		"properties": {
+			"kubernetesVersion": "1.24.3",
+			"agentPoolProfiles": [
+				{"name": "nodepool1", "count": 3, "vmSize": "Standard_D4s_v3", "mode": "System"},
+				{"name": "scaled", "count": 1, "enableAutoScaling": true}
+			]
+		}
+	}`
+
+	testCases := []struct {
+		name      string
+		requested string
+		existing  string
+		expected  []string
+	}{
+		{
+			name: "matching",
+			existing: `{
+				"tags": {"kubetest2-aks-custom-config-hash": "abc"},
+				"properties": {
+					"provisioningState": "Succeeded",
+					"kubernetesVersion": "1.24.3",
+					"agentPoolProfiles": [
+						{"name": "nodepool1", "count": 3, "vmSize": "standard_d4s_v3", "mode": "System", "osType": "Linux"},
+						{"name": "scaled", "count": 5, "enableAutoScaling": true}
+					]
+				}
+			}`,
+		},
+		{
+			name: "failed with another version",
+			existing: `{
+				"tags": {"kubetest2-aks-custom-config-hash": "abc"},
+				"properties": {
+					"provisioningState": "Failed",
+					"kubernetesVersion": "1.23.8",
+					"agentPoolProfiles": [
+						{"name": "nodepool1", "count": 3, "vmSize": "Standard_D4s_v3", "mode": "System"},
+						{"name": "scaled", "count": 1}
+					]
+				}
+			}`,
+			expected: []string{
+				`provisioning state is "Failed"`,
+				"Kubernetes version is 1.23.8 instead of 1.24.3",
+			},
+		},
+		{
+			name:      "older patch of the requested minor version",
+			requested: "1.24",
+			existing: `{
+				"tags": {"kubetest2-aks-custom-config-hash": "abc"},
+				"properties": {
+					"provisioningState": "Succeeded",
+					"kubernetesVersion": "1.24.1",
+					"agentPoolProfiles": [
+						{"name": "nodepool1", "count": 3, "vmSize": "Standard_D4s_v3", "mode": "System"},
+						{"name": "scaled", "count": 1}
+					]
+				}
+			}`,
+		},
+		{
+			name:      "older minor version of an alias",
+			requested: "latest",
+			existing: `{
+				"tags": {"kubetest2-aks-custom-config-hash": "abc"},
+				"properties": {
+					"provisioningState": "Succeeded",
+					"kubernetesVersion": "1.23.8",
+					"agentPoolProfiles": [
+						{"name": "nodepool1", "count": 3, "vmSize": "Standard_D4s_v3", "mode": "System"},
+						{"name": "scaled", "count": 1}
+					]
+				}
+			}`,
+			expected: []string{"Kubernetes version is 1.23.8 instead of 1.24.3"},
+		},
+		{
+			name:      "older patch of the requested exact version",
+			requested: "1.24.3",
+			existing: `{
+				"tags": {"kubetest2-aks-custom-config-hash": "abc"},
+				"properties": {
+					"provisioningState": "Succeeded",
+					"kubernetesVersion": "1.24.1",
+					"agentPoolProfiles": [
+						{"name": "nodepool1", "count": 3, "vmSize": "Standard_D4s_v3", "mode": "System"},
+						{"name": "scaled", "count": 1}
+					]
+				}
+			}`,
+			expected: []string{"Kubernetes version is 1.24.1 instead of 1.24.3"},
+		},
+		{
+			name: "different pools",
+			existing: `{
+				"tags": {"kubetest2-aks-custom-config-hash": "abc"},
+				"properties": {
+					"provisioningState": "Succeeded",
+					"kubernetesVersion": "1.24.3",
+					"agentPoolProfiles": [
+						{"name": "nodepool1", "count": 1, "vmSize": "Standard_D4s_v3", "mode": "User"}
+					]
+				}
+			}`,
+			expected: []string{
+				"1 agent pools instead of 2",
+				`agent pool "nodepool1" has count 1 instead of 3`,
+				`agent pool "nodepool1" has mode User instead of System`,
+				`agent pool "scaled" does not exist`,
+			},
+		},
+		{
+			name: "other custom configuration",
+			existing: `{
+				"properties": {
+					"provisioningState": "Succeeded",
+					"kubernetesVersion": "1.24.3",
+					"agentPoolProfiles": [
+						{"name": "nodepool1", "count": 3, "vmSize": "Standard_D4s_v3", "mode": "System"},
+						{"name": "scaled", "count": 1}
+					]
+				}
+			}`,
+			expected: []string{"custom configuration differs"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var templateConfig, existing map[string]interface{}
+			if err := json.Unmarshal([]byte(template), &templateConfig); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tc.existing), &existing); err != nil {
+				t.Fatal(err)
+			}
+			if mismatches := clusterSpecMismatches(templateConfig, existing, tc.requested); !reflect.DeepEqual(mismatches, tc.expected) {
+				t.Errorf("expected mismatches %q, got %q", tc.expected, mismatches)
+			}
+		})
+	}
+}
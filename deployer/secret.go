@@ -0,0 +1,147 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"k8s.io/klog"
+)
+
+var (
+	keyVaultAPIVersion = "7.3"
+	keyVaultScope      = "https://vault.azure.net/.default"
+
+	// The client secret is resolved once, by the first phase needing it.
+	clientSecretOnce sync.Once
+	clientSecretErr  error
+)
+
+// resolveClientSecret reads the client secret from --clientSecretFile or
+// --clientSecretKeyVault, if set, instead of AZURE_CLIENT_SECRET.
+func (d *deployer) resolveClientSecret() error {
+	clientSecretOnce.Do(func() {
+		var secret string
+		switch {
+		case d.ClientSecretFile != "" && d.ClientSecretKeyVault != "":
+			clientSecretErr = fmt.Errorf("--clientSecretFile and --clientSecretKeyVault are mutually exclusive")
+			return
+		case d.ClientSecretFile != "":
+			data, err := ioutil.ReadFile(d.ClientSecretFile)
+			if err != nil {
+				clientSecretErr = fmt.Errorf("failed to read client secret file %q: %v", d.ClientSecretFile, err)
+				return
+			}
+			secret = strings.TrimSpace(string(data))
+		case d.ClientSecretKeyVault != "":
+			s, err := d.getKeyVaultSecret(d.ClientSecretKeyVault)
+			if err != nil {
+				clientSecretErr = fmt.Errorf("failed to get client secret from Key Vault: %v", err)
+				return
+			}
+			secret = s
+		default:
+			return
+		}
+		if secret == "" {
+			clientSecretErr = fmt.Errorf("client secret is empty")
+			return
+		}
+		addSecretValue(secret)
+		clientSecret = secret
+		// DefaultAzureCredential reads the client secret from the environment
+		if err := os.Setenv("AZURE_CLIENT_SECRET", secret); err != nil {
+			clientSecretErr = fmt.Errorf("failed to set AZURE_CLIENT_SECRET: %v", err)
+		}
+	})
+	return clientSecretErr
+}
+
+// getKeyVaultSecret gets the value of a Key Vault secret by its identifier,
+// https://<vault>.vault.azure.net/secrets/<name>[/<version>], with the identity
+// of the environment, like a managed identity or the Azure CLI.
+func (d *deployer) getKeyVaultSecret(secretID string) (string, error) {
+	u, err := url.Parse(secretID)
+	if err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Path, "/secrets/") {
+		return "", fmt.Errorf("%q is not a Key Vault secret identifier", secretID)
+	}
+	query := u.Query()
+	query.Set("api-version", keyVaultAPIVersion)
+	u.RawQuery = query.Encode()
+
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get credential: %v", err)
+	}
+	token, err := cred.GetToken(d.ctx, policy.TokenRequestOptions{Scopes: []string{keyVaultScope}})
+	if err != nil {
+		return "", fmt.Errorf("failed to get Key Vault token: %v", err)
+	}
+	addSecretValue(token.Token)
+
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret %q: %v", secretID, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %q: %v", secretID, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get secret %q: status %d: %s", secretID, resp.StatusCode, redactBody(body))
+	}
+	secret := struct {
+		Value string `json:"value"`
+	}{}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("failed to decode secret %q: %v", secretID, err)
+	}
+	klog.Infof("Read the client secret from Key Vault secret %q", secretID)
+	return secret.Value, nil
+}
+
+// newCredential resolves the client secret and returns the default Azure credential.
+func (d *deployer) newCredential() (*azidentity.DefaultAzureCredential, error) {
+	if err := d.resolveClientSecret(); err != nil {
+		return nil, err
+	}
+	return azidentity.NewDefaultAzureCredential(nil)
+}
+
+// writePrivateFile writes data readable by the owner only, like kubeconfigs and the
+// state file, also tightening the mode of an existing file.
+func writePrivateFile(path string, data []byte) error {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
@@ -0,0 +1,338 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+	"sigs.k8s.io/kubetest2/pkg/artifacts"
+)
+
+var (
+	resourcesAPIVersion = "2021-04-01"
+
+	upSnapshotFileName   = "resources-after-up.json"
+	downSnapshotFileName = "resources-before-down.json"
+	snapshotDiffFileName = "resources-diff.txt"
+
+	// The cloud provider deletes the resources of a Service some time after its
+	// namespace is deleted.
+	leakWaitTimeout  = 5 * time.Minute
+	leakWaitInterval = 30 * time.Second
+
+	// clusterNameTag is set by the cloud provider on the resources it creates.
+	clusterNameTag = "k8s-azure-cluster-name"
+
+	// Types of the rules the cloud provider adds to the shared load balancers and
+	// network security groups.
+	loadBalancerFrontendType = "Microsoft.Network/loadBalancers/frontendIPConfigurations"
+	loadBalancerRuleType     = "Microsoft.Network/loadBalancers/loadBalancingRules"
+	loadBalancerProbeType    = "Microsoft.Network/loadBalancers/probes"
+	securityRuleType         = "Microsoft.Network/networkSecurityGroups/securityRules"
+)
+
+// resourceSnapshot holds the ARM resources of the resource groups of the run, with
+// the rules of their load balancers and network security groups.
+type resourceSnapshot struct {
+	TakenAt time.Time `json:"takenAt"`
+	// ResourceGroups are the resources by lowercase ID, by resource group.
+	ResourceGroups map[string]map[string]snapshotResource `json:"resourceGroups"`
+}
+
+type snapshotResource struct {
+	ID   string            `json:"id"`
+	Type string            `json:"type"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// ccmManaged returns true if the cloud provider creates the resource for Services.
+func (r snapshotResource) ccmManaged() bool {
+	for _, tag := range []string{serviceTag, ownerServiceTag, clusterNameTag} {
+		if _, ok := r.Tags[tag]; ok {
+			return true
+		}
+	}
+	switch r.Type {
+	case "Microsoft.Network/loadBalancers", loadBalancerFrontendType, loadBalancerRuleType, loadBalancerProbeType, securityRuleType:
+		return true
+	}
+	return false
+}
+
+// snapshotResourceGroup lists the resources of the resource group, and the rules of
+// its load balancers and network security groups.
+func (d *deployer) snapshotResourceGroup(resourceGroup string) (map[string]snapshotResource, error) {
+	values, err := d.listRawResources(resourcesAPIVersion, fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/resources", subscriptionID, resourceGroup))
+	if err != nil {
+		return nil, err
+	}
+	resources := map[string]snapshotResource{}
+	add := func(r snapshotResource) {
+		resources[strings.ToLower(r.ID)] = r
+	}
+	for _, raw := range values {
+		r := snapshotResource{}
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return nil, fmt.Errorf("failed to decode resource of resource group %q: %v", resourceGroup, err)
+		}
+		add(r)
+	}
+
+	// Rules are not listed as resources
+	for _, resourceType := range []string{"Microsoft.Network/loadBalancers", "Microsoft.Network/networkSecurityGroups"} {
+		values, err := d.listRawResources(networkAPIVersion, fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/%s", subscriptionID, resourceGroup, resourceType))
+		if err != nil {
+			return nil, err
+		}
+		for _, raw := range values {
+			resource := networkResource{}
+			if err := json.Unmarshal(raw, &resource); err != nil {
+				return nil, fmt.Errorf("failed to decode %s: %v", resourceType, err)
+			}
+			for subResourceType, subResources := range map[string][]subResource{
+				loadBalancerFrontendType: resource.Properties.FrontendIPConfigurations,
+				loadBalancerRuleType:     resource.Properties.LoadBalancingRules,
+				loadBalancerProbeType:    resource.Properties.Probes,
+				securityRuleType:         resource.Properties.SecurityRules,
+			} {
+				for _, s := range subResources {
+					add(snapshotResource{
+						ID:   fmt.Sprintf("%s/%s/%s", resource.ID, filepath.Base(subResourceType), s.Name),
+						Type: subResourceType,
+					})
+				}
+			}
+		}
+	}
+	return resources, nil
+}
+
+// takeResourceSnapshot snapshots the resource groups, skipping those that do not exist.
+func (d *deployer) takeResourceSnapshot(resourceGroups []string) (*resourceSnapshot, error) {
+	snapshot := &resourceSnapshot{
+		TakenAt:        time.Now(),
+		ResourceGroups: map[string]map[string]snapshotResource{},
+	}
+	for _, resourceGroup := range resourceGroups {
+		exists, err := d.resourceExists(resourcesAPIVersion, fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", subscriptionID, resourceGroup))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			klog.Infof("Resource group %q does not exist, not snapshotting it", resourceGroup)
+			continue
+		}
+		resources, err := d.snapshotResourceGroup(resourceGroup)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.ResourceGroups[resourceGroup] = resources
+	}
+	return snapshot, nil
+}
+
+// snapshotResourceGroups returns the resource group and the node resource groups of
+// the clusters.
+func (d *deployer) snapshotResourceGroups() ([]string, error) {
+	clusters, err := d.clusters()
+	if err != nil {
+		return nil, err
+	}
+	resourceGroups := []string{d.ResourceGroupName}
+	for _, c := range clusters {
+		nodeResourceGroup, err := c.nodeResourceGroup()
+		if err != nil {
+			return nil, err
+		}
+		resourceGroups = append(resourceGroups, nodeResourceGroup)
+	}
+	return resourceGroups, nil
+}
+
+// snapshotResourcesAfterUp records the resources of the run in the state file and
+// the artifacts, for Down to diff them.
+func (d *deployer) snapshotResourcesAfterUp() error {
+	resourceGroups, err := d.snapshotResourceGroups()
+	if err != nil {
+		return err
+	}
+	snapshot, err := d.takeResourceSnapshot(resourceGroups)
+	if err != nil {
+		return err
+	}
+	if err := d.updateState(func(state *runState) {
+		state.ResourceSnapshot = snapshot
+	}); err != nil {
+		return fmt.Errorf("failed to update state: %v", err)
+	}
+	return writeJSONDiagnostics(artifacts.BaseDir(), upSnapshotFileName, snapshot)
+}
+
+// diffResourcesBeforeDown snapshots the resource groups snapshotted after Up again
+// and reports the diff. With --failOnLeakedResources, it waits for the cloud provider
+// to delete the resources it created during the tests, and fails if it does not.
+func (d *deployer) diffResourcesBeforeDown() error {
+	state, err := d.loadState()
+	if err != nil {
+		return err
+	}
+	before := state.ResourceSnapshot
+	if before == nil {
+		klog.Infof("No resources were snapshotted after Up, not diffing them")
+		return nil
+	}
+	var resourceGroups []string
+	for resourceGroup := range before.ResourceGroups {
+		resourceGroups = append(resourceGroups, resourceGroup)
+	}
+	sort.Strings(resourceGroups)
+
+	var after *resourceSnapshot
+	var leaks []string
+	err = wait.PollImmediateWithContext(d.ctx, leakWaitInterval, leakWaitTimeout, func(ctx context.Context) (done bool, err error) {
+		after, err = d.takeResourceSnapshot(resourceGroups)
+		if err != nil {
+			return false, err
+		}
+		leaks = leakedResources(before, after)
+		if len(leaks) > 0 && d.FailOnLeakedResources {
+			klog.Infof("Waiting for %d resources created during the tests to be deleted", len(leaks))
+		}
+		return len(leaks) == 0 || !d.FailOnLeakedResources, nil
+	})
+	if err != nil && err != wait.ErrWaitTimeout {
+		return err
+	}
+
+	if err := writeJSONDiagnostics(artifacts.BaseDir(), downSnapshotFileName, after); err != nil {
+		return err
+	}
+	diff := diffResourceSnapshots(before, after)
+	path := filepath.Join(artifacts.BaseDir(), snapshotDiffFileName)
+	if err := os.MkdirAll(artifacts.BaseDir(), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to mkdir the artifacts dir: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(diff), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	klog.Infof("Resources changed since Up are written to %s", path)
+
+	if len(leaks) > 0 {
+		message := fmt.Sprintf("%d resources created during the tests were not deleted:\n%s", len(leaks), strings.Join(leaks, "\n"))
+		if d.FailOnLeakedResources {
+			return fmt.Errorf("%s", message)
+		}
+		klog.Warning(message)
+	}
+	return nil
+}
+
+// leakedResources returns the resources the cloud provider created after Up which
+// still exist.
+func leakedResources(before, after *resourceSnapshot) []string {
+	var leaks []string
+	for resourceGroup, resources := range after.ResourceGroups {
+		for key, r := range resources {
+			if _, ok := before.ResourceGroups[resourceGroup][key]; !ok && r.ccmManaged() {
+				leaks = append(leaks, r.ID)
+			}
+		}
+	}
+	sort.Strings(leaks)
+	return leaks
+}
+
+// diffResourceSnapshots lists the resources added, removed and retagged between the
+// snapshots, by resource group.
+func diffResourceSnapshots(before, after *resourceSnapshot) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Resources after Up at %s and before Down at %s\n", before.TakenAt.UTC().Format(time.RFC3339), after.TakenAt.UTC().Format(time.RFC3339))
+	var resourceGroups []string
+	for resourceGroup := range before.ResourceGroups {
+		resourceGroups = append(resourceGroups, resourceGroup)
+	}
+	sort.Strings(resourceGroups)
+
+	for _, resourceGroup := range resourceGroups {
+		fmt.Fprintf(&b, "\nResource group %s\n", resourceGroup)
+		beforeResources := before.ResourceGroups[resourceGroup]
+		afterResources, ok := after.ResourceGroups[resourceGroup]
+		if !ok {
+			fmt.Fprintf(&b, "  deleted\n")
+			continue
+		}
+		var lines []string
+		for key, r := range afterResources {
+			old, ok := beforeResources[key]
+			if !ok {
+				lines = append(lines, fmt.Sprintf("  + %s%s", r.ID, ccmMarker(r)))
+				continue
+			}
+			for _, tag := range changedTags(old.Tags, r.Tags) {
+				lines = append(lines, fmt.Sprintf("  ~ %s tag %s", r.ID, tag))
+			}
+		}
+		for key, r := range beforeResources {
+			if _, ok := afterResources[key]; !ok {
+				lines = append(lines, fmt.Sprintf("  - %s", r.ID))
+			}
+		}
+		if len(lines) == 0 {
+			fmt.Fprintf(&b, "  unchanged\n")
+			continue
+		}
+		sort.Slice(lines, func(i, j int) bool { return lines[i][4:] < lines[j][4:] })
+		fmt.Fprintf(&b, "%s\n", strings.Join(lines, "\n"))
+	}
+	return b.String()
+}
+
+func ccmMarker(r snapshotResource) string {
+	if r.ccmManaged() {
+		return " (cloud provider)"
+	}
+	return ""
+}
+
+// changedTags describes the tags added, removed or changed.
+func changedTags(before, after map[string]string) []string {
+	var changes []string
+	for k, v := range after {
+		if old, ok := before[k]; !ok {
+			changes = append(changes, fmt.Sprintf("%s=%q added", k, v))
+		} else if old != v {
+			changes = append(changes, fmt.Sprintf("%s %q -> %q", k, old, v))
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changes = append(changes, fmt.Sprintf("%s removed", k))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
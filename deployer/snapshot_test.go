@@ -0,0 +1,113 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func snapshot(takenAt time.Time, resourceGroups map[string][]snapshotResource) *resourceSnapshot {
+	s := &resourceSnapshot{TakenAt: takenAt, ResourceGroups: map[string]map[string]snapshotResource{}}
+	for resourceGroup, resources := range resourceGroups {
+		s.ResourceGroups[resourceGroup] = map[string]snapshotResource{}
+		for _, r := range resources {
+			s.ResourceGroups[resourceGroup][strings.ToLower(r.ID)] = r
+		}
+	}
+	return s
+}
+
+func TestDiffResourceSnapshots(t *testing.T) {
+	upAt := time.Date(2022, 8, 1, 10, 0, 0, 0, time.UTC)
+	downAt := upAt.Add(time.Hour)
+	vnet := snapshotResource{ID: "/rg/vnet", Type: "Microsoft.Network/virtualNetworks", Tags: map[string]string{"owner": "ci"}}
+	lb := snapshotResource{ID: "/mc/kubernetes", Type: "Microsoft.Network/loadBalancers"}
+	pip := snapshotResource{ID: "/mc/kubernetes-a1234", Type: "Microsoft.Network/publicIPAddresses", Tags: map[string]string{serviceTag: "default/web"}}
+	disk := snapshotResource{ID: "/mc/disk", Type: "Microsoft.Compute/disks"}
+
+	testCases := []struct {
+		name     string
+		before   map[string][]snapshotResource
+		after    map[string][]snapshotResource
+		expected string
+		leaks    []string
+	}{
+		{
+			name:   "unchanged",
+			before: map[string][]snapshotResource{"rg": {vnet}},
+			after:  map[string][]snapshotResource{"rg": {vnet}},
+			expected: `
+Resource group rg
+  unchanged
+`,
+		},
+		{
+			name:   "added, removed and retagged",
+			before: map[string][]snapshotResource{"rg": {vnet}, "mc": {lb, disk}},
+			after: map[string][]snapshotResource{
+				"rg": {{ID: vnet.ID, Type: vnet.Type, Tags: map[string]string{"owner": "e2e", "run": "1"}}},
+				"mc": {lb, pip},
+			},
+			expected: `
+Resource group mc
+  - /mc/disk
+  + /mc/kubernetes-a1234 (cloud provider)
+
+Resource group rg
+  ~ /rg/vnet tag owner "ci" -> "e2e"
+  ~ /rg/vnet tag run="1" added
+`,
+			leaks: []string{"/mc/kubernetes-a1234"},
+		},
+		{
+			name:   "deleted resource group",
+			before: map[string][]snapshotResource{"rg": {vnet}, "mc": {lb}},
+			after:  map[string][]snapshotResource{"rg": {vnet}},
+			expected: `
+Resource group mc
+  deleted
+
+Resource group rg
+  unchanged
+`,
+		},
+		{
+			name:   "resources which are not the cloud provider's do not leak",
+			before: map[string][]snapshotResource{"mc": {lb}},
+			after:  map[string][]snapshotResource{"mc": {lb, disk}},
+			expected: `
+Resource group mc
+  + /mc/disk
+`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			before, after := snapshot(upAt, tc.before), snapshot(downAt, tc.after)
+			expected := "Resources after Up at 2022-08-01T10:00:00Z and before Down at 2022-08-01T11:00:00Z\n" + tc.expected
+			if diff := diffResourceSnapshots(before, after); diff != expected {
+				t.Errorf("expected diff:\n%s\ngot:\n%s", expected, diff)
+			}
+			if leaks := leakedResources(before, after); !reflect.DeepEqual(leaks, tc.leaks) {
+				t.Errorf("expected leaks %q, got %q", tc.leaks, leaks)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	defaultStateDir = "_state"
+
+	// stateLock serializes updates of the state file by concurrent cluster operations.
+	stateLock sync.Mutex
+)
+
+// runState records what Up created and how to reach it. It is persisted to the
+// state file so testers and later invocations of the deployer can read it.
+type runState struct {
+	ResourceGroupName string `json:"resourceGroupName"`
+	Location          string `json:"location"`
+	// ResourceGroupCreated is true if the resource group did not exist before Up.
+	ResourceGroupCreated bool `json:"resourceGroupCreated,omitempty"`
+	// AttemptedLocations lists the locations Up tried, the last one being Location.
+	AttemptedLocations []string `json:"attemptedLocations,omitempty"`
+	// CreatedResources lists the resources Up created, in order of creation.
+	CreatedResources []createdResource `json:"createdResources,omitempty"`
+	Clusters         []clusterState    `json:"clusters,omitempty"`
+	// MergedKubeconfig has one context per cluster.
+	MergedKubeconfig string `json:"mergedKubeconfig,omitempty"`
+	// PendingOperations are the long-running operations in flight.
+	PendingOperations []pendingOperation `json:"pendingOperations,omitempty"`
+	// Adopted is true if Up attached to existing clusters, which Down must not delete.
+	Adopted bool `json:"adopted,omitempty"`
+	// Interrupted is the signal that interrupted the run, if any.
+	Interrupted string `json:"interrupted,omitempty"`
+	// CustomRoleDefinitionID is the role definition of --roleDefinition, which is not
+	// deleted with the resource group.
+	CustomRoleDefinitionID string `json:"customRoleDefinitionID,omitempty"`
+	// ResourceSnapshot holds the resources of the run after Up, diffed before Down.
+	ResourceSnapshot *resourceSnapshot `json:"resourceSnapshot,omitempty"`
+}
+
+type clusterState struct {
+	ClusterName string `json:"clusterName"`
+	Location    string `json:"location"`
+	K8sVersion  string `json:"k8sVersion,omitempty"`
+	Kubeconfig  string `json:"kubeconfig,omitempty"`
+	// UpAt is when Up started for the cluster, and HourlyCost its estimated hourly cost.
+	UpAt       time.Time `json:"upAt"`
+	HourlyCost float64   `json:"hourlyCost,omitempty"`
+	Currency   string    `json:"currency,omitempty"`
+
+	// RunID tags the cluster, and so the resources its cloud provider creates, for Down
+	// to delete only those.
+	RunID string `json:"runID,omitempty"`
+	// CCMClusterName is the cluster name the cloud provider tags its resources with.
+	CCMClusterName string `json:"ccmClusterName,omitempty"`
+
+	APIServerAccess  *apiServerAccess  `json:"apiServerAccess,omitempty"`
+	ControlPlaneLogs *controlPlaneLogs `json:"controlPlaneLogs,omitempty"`
+}
+
+// apiServerAccess documents how testers reach the API server of the cluster.
+type apiServerAccess struct {
+	// Method is one of "public", "commandInvoke" or "jumpVM".
+	Method string `json:"method"`
+	FQDN   string `json:"fqdn,omitempty"`
+	// Instructions is a human-readable description of the access method.
+	Instructions string `json:"instructions,omitempty"`
+
+	JumpVM *jumpVMAccess `json:"jumpVM,omitempty"`
+}
+
+type jumpVMAccess struct {
+	PublicIP       string `json:"publicIP"`
+	AdminUsername  string `json:"adminUsername"`
+	PrivateKeyPath string `json:"privateKeyPath"`
+	// TunnelCommand opens a SOCKS5 proxy used by ProxyKubeconfig.
+	TunnelCommand   string `json:"tunnelCommand"`
+	ProxyKubeconfig string `json:"proxyKubeconfig"`
+}
+
+func (d *deployer) stateFilePath() string {
+	if d.StateFile != "" {
+		return d.StateFile
+	}
+	return filepath.Join(defaultStateDir, fmt.Sprintf("%s.json", d.ResourceGroupName))
+}
+
+// loadState reads the state file, returning an empty state if it does not exist.
+func (d *deployer) loadState() (*runState, error) {
+	state := &runState{}
+	data, err := ioutil.ReadFile(d.stateFilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("failed to read state file %q: %v", d.stateFilePath(), err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal state file %q: %v", d.stateFilePath(), err)
+	}
+	return state, nil
+}
+
+// saveState writes the state file.
+func (d *deployer) saveState(state *runState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(d.stateFilePath()), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to mkdir the state dir: %v", err)
+	}
+	if err := writePrivateFile(d.stateFilePath(), data); err != nil {
+		return fmt.Errorf("failed to write state file %q: %v", d.stateFilePath(), err)
+	}
+	return nil
+}
+
+// updateState loads the state file, applies update and saves it.
+func (d *deployer) updateState(update func(state *runState)) error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	state, err := d.loadState()
+	if err != nil {
+		return err
+	}
+	update(state)
+	return d.saveState(state)
+}
+
+// updateClusterState applies update to the state entry of the deployer's cluster,
+// adding the entry if it does not exist.
+func (d *deployer) updateClusterState(update func(cluster *clusterState)) error {
+	return d.updateState(func(state *runState) {
+		for i := range state.Clusters {
+			if state.Clusters[i].ClusterName == d.ClusterName {
+				update(&state.Clusters[i])
+				return
+			}
+		}
+		state.Clusters = append(state.Clusters, clusterState{ClusterName: d.ClusterName})
+		update(&state.Clusters[len(state.Clusters)-1])
+	})
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	"sigs.k8s.io/kubetest2/pkg/artifacts"
+)
+
+var (
+	timingsFileName = "aks-timings.json"
+	junitClassName  = "kubetest2-aks"
+
+	// stepResults are the steps run by this invocation, appended by concurrent clusters.
+	stepResults []stepResult
+	stepsLock   sync.Mutex
+)
+
+// stepResult is the outcome of one internal step of a phase.
+type stepResult struct {
+	Phase    string    `json:"phase"`
+	Name     string    `json:"name"`
+	Cluster  string    `json:"cluster,omitempty"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"durationSeconds"`
+	Failure  string    `json:"failure,omitempty"`
+}
+
+// phaseResult is the outcome of a phase and its steps in the timing summary.
+type phaseResult struct {
+	Phase    string       `json:"phase"`
+	Start    time.Time    `json:"start"`
+	Duration float64      `json:"durationSeconds"`
+	Failure  string       `json:"failure,omitempty"`
+	Steps    []stepResult `json:"steps"`
+}
+
+// timings is the JSON timing summary of the phases run so far.
+type timings struct {
+	Phases []phaseResult `json:"phases"`
+}
+
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Failures int             `xml:"failures,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Time     float64         `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string  `xml:"name,attr"`
+	ClassName string  `xml:"classname,attr"`
+	Time      float64 `xml:"time,attr"`
+	Failure   string  `xml:"failure,omitempty"`
+}
+
+// step runs fn as a step of the phase and records its duration and failure.
+func (d *deployer) step(name string, fn func() error) error {
+	return d.runStep(name, "", fn)
+}
+
+// clusterStep runs fn as a step of the phase for the deployer's cluster.
+func (d *deployer) clusterStep(name string, fn func() error) error {
+	return d.runStep(name, d.ClusterName, fn)
+}
+
+func (d *deployer) runStep(name, cluster string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	result := stepResult{
+		Phase:    d.phase,
+		Name:     name,
+		Cluster:  cluster,
+		Start:    start,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		result.Failure = redactText(err.Error())
+	}
+	stepsLock.Lock()
+	defer stepsLock.Unlock()
+	stepResults = append(stepResults, result)
+	return err
+}
+
+// phaseSteps returns the steps recorded for the phase.
+func phaseSteps(phase string) []stepResult {
+	stepsLock.Lock()
+	defer stepsLock.Unlock()
+	var steps []stepResult
+	for _, step := range stepResults {
+		if step.Phase == phase {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// writePhaseResults writes the JUnit XML of the phase's steps and adds the phase
+// to the timing summary in the artifacts directory. Failing to write them never
+// fails the phase.
+func (d *deployer) writePhaseResults(err error) {
+	result := phaseResult{
+		Phase:    d.phase,
+		Start:    d.phaseStart,
+		Duration: time.Since(d.phaseStart).Seconds(),
+		Steps:    phaseSteps(d.phase),
+	}
+	if err != nil {
+		result.Failure = redactText(err.Error())
+	}
+	if err := os.MkdirAll(artifacts.BaseDir(), os.ModePerm); err != nil {
+		klog.Warningf("failed to mkdir the artifacts dir: %v", err)
+		return
+	}
+	if err := writeJUnit(result); err != nil {
+		klog.Warningf("failed to write JUnit of %s: %v", d.phase, err)
+	}
+	if err := writeTimings(result); err != nil {
+		klog.Warningf("failed to write timings of %s: %v", d.phase, err)
+	}
+}
+
+func writeJUnit(result phaseResult) error {
+	suite := junitTestSuite{
+		Name: fmt.Sprintf("%s %s", junitClassName, result.Phase),
+		Time: result.Duration,
+	}
+	for _, step := range result.Steps {
+		name := fmt.Sprintf("%s: %s", step.Phase, step.Name)
+		if step.Cluster != "" {
+			name = fmt.Sprintf("%s [%s]", name, step.Cluster)
+		}
+		suite.Tests++
+		if step.Failure != "" {
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, junitTestCase{
+			Name:      name,
+			ClassName: junitClassName,
+			Time:      step.Duration,
+			Failure:   step.Failure,
+		})
+	}
+	data, err := xml.MarshalIndent(suite, "", "    ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(artifacts.BaseDir(), fmt.Sprintf("junit_aks_%s.xml", strings.ToLower(result.Phase)))
+	return ioutil.WriteFile(path, append([]byte(xml.Header), data...), 0644)
+}
+
+// writeTimings replaces the phase in the timing summary, keeping the phases run by
+// earlier invocations.
+func writeTimings(result phaseResult) error {
+	path := filepath.Join(artifacts.BaseDir(), timingsFileName)
+	summary := timings{}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &summary); err != nil {
+			klog.Warningf("failed to parse timings %q, overwriting it: %v", path, err)
+			summary = timings{}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	phases := []phaseResult{}
+	for _, phase := range summary.Phases {
+		if phase.Phase != result.Phase {
+			phases = append(phases, phase)
+		}
+	}
+	summary.Phases = append(phases, result)
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -41,7 +41,6 @@ import (
 
 	azclients "sigs.k8s.io/cloud-provider-azure/pkg/azureclients"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/armclient"
-	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/containerserviceclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
 
 	"sigs.k8s.io/kubetest2/pkg/exec"
@@ -50,31 +49,105 @@ import (
 var (
 	apiVersion           = "2022-04-02-preview"
 	defaultKubeconfigDir = "_kubeconfig"
+	defaultClusterName   = "aks-cluster"
 )
 
 type UpOptions struct {
-	ClusterName      string `flag:"clusterName" desc:"--clusterName flag for aks cluster name"`
-	Location         string `flag:"location" desc:"--location flag for resource group and cluster location"`
-	CCMImageTag      string `flag:"ccmImageTag" desc:"--ccmImageTag flag for CCM image tag"`
-	ConfigPath       string `flag:"config" desc:"--config flag for AKS cluster"`
-	CustomConfigPath string `flag:"customConfig" desc:"--customConfig flag for custom configuration"`
-	K8sVersion       string `flag:"k8sVersion" desc:"--k8sVersion flag for cluster Kubernetes version"`
+	ClusterName       string   `flag:"clusterName" desc:"--clusterName flag for aks cluster name"`
+	ClusterSpecsPath  string   `flag:"clusters" desc:"--clusters flag for a JSON file listing clusters (name, config, location, k8sVersion) to create concurrently"`
+	Location          string   `flag:"location" desc:"--location flag for resource group and cluster location"`
+	FallbackLocations []string `flag:"fallbackLocations" desc:"--fallbackLocations flag for locations tried in order when the VM size is unavailable or the quota is exhausted in --location"`
+	CCMImageTag       string   `flag:"ccmImageTag" desc:"--ccmImageTag flag for CCM image tag"`
+	ConfigPath        string   `flag:"config" desc:"--config flag for AKS cluster"`
+	CustomConfigPath  string   `flag:"customConfig" desc:"--customConfig flag for custom configuration"`
+	K8sVersion        string   `flag:"k8sVersion" desc:"--k8sVersion flag for cluster Kubernetes version, an exact version or an alias: latest, default, <major>.<minor>, n-<offset>"`
+
+	K8sVersionPreview bool `flag:"k8sVersionPreview" desc:"--k8sVersionPreview flag to allow resolving to preview Kubernetes versions"`
+
+	NetworkSpecPath string   `flag:"networkSpec" desc:"--networkSpec flag for a JSON file describing a customer virtual network to create"`
+	VnetCIDR        string   `flag:"vnetCIDR" desc:"--vnetCIDR flag for the address prefix of a customer virtual network to create"`
+	SubnetCIDRs     []string `flag:"subnetCIDRs" desc:"--subnetCIDRs flag for subnets of the customer virtual network as <name>=<cidr>"`
+	RouteTable      bool     `flag:"routeTable" desc:"--routeTable flag to create a route table for the customer virtual network subnets"`
+	SecurityGroup   bool     `flag:"securityGroup" desc:"--securityGroup flag to create a network security group for the customer virtual network subnets"`
+
+	IdentityType       string `flag:"identityType" desc:"--identityType flag for cluster identity: servicePrincipal (default), systemAssigned or userAssigned"`
+	RoleDefinitionPath string `flag:"roleDefinition" desc:"--roleDefinition flag for a custom role definition file assigned to user-assigned identities instead of Network Contributor"`
+
+	Private                  bool   `flag:"private" desc:"--private flag to create a private cluster"`
+	APIServerVnetIntegration bool   `flag:"apiServerVnetIntegration" desc:"--apiServerVnetIntegration flag to use API server VNet integration instead of private link for a private cluster"`
+	PrivateAccess            string `flag:"privateAccess" desc:"--privateAccess flag for how testers reach a private API server: commandInvoke (default) or jumpVM"`
+	JumpSourcePrefix         string `flag:"jumpSourcePrefix" desc:"--jumpSourcePrefix flag for the address prefix allowed to SSH to the jump VM, required with --privateAccess jumpVM"`
+
+	PostUpManifests  []string      `flag:"postUpManifests" desc:"--postUpManifests flag for manifest files, directories or URLs applied after the cluster is up"`
+	PostUpHelmCharts []string      `flag:"postUpHelmCharts" desc:"--postUpHelmCharts flag for helm charts installed after the cluster is up as [<namespace>/]<release>=<chart>"`
+	PostUpHelmValues []string      `flag:"postUpHelmValues" desc:"--postUpHelmValues flag for values files of the post-Up helm charts as <release>=<values file>"`
+	PostUpTimeout    time.Duration `flag:"postUpTimeout" desc:"--postUpTimeout flag for how long to wait for post-Up manifests and helm charts to be ready, defaults to 10m"`
+
+	ControlPlaneLogs string `flag:"controlPlaneLogs" desc:"--controlPlaneLogs flag to send the control-plane logs of the clusters to a storage account (storage) or a Log Analytics workspace (logAnalytics) DumpClusterLogs downloads them from"`
+
+	CleanupOnFailure bool `flag:"cleanupOnFailure" desc:"--cleanupOnFailure flag to dump diagnostics and delete what the run created when Up fails"`
+
+	ReuseCluster bool `flag:"reuseCluster" desc:"--reuseCluster flag to skip creating a cluster that exists and matches the template"`
+	Adopt        bool `flag:"adopt" desc:"--adopt flag to attach to existing clusters read-only instead of creating anything"`
+
+	DumpNetworkOnly bool `flag:"dumpNetworkOnly" desc:"--dumpNetworkOnly flag to dump the network resources of existing clusters to the artifacts without creating anything"`
+
+	PreflightOnly bool `flag:"preflightOnly" desc:"--preflightOnly flag to run the preflight checks of Up without creating anything"`
+	SkipPreflight bool `flag:"skipPreflight" desc:"--skipPreflight flag to skip the preflight checks of Up"`
+
+	UpTimeout time.Duration `flag:"upTimeout" desc:"--upTimeout flag for how long Up may take, 0 for no limit"`
+
+	ReadinessTimeout time.Duration `flag:"readinessTimeout" desc:"--readinessTimeout flag for how long to wait for nodes to be Ready and initialized by the custom cloud provider, defaults to 15m"`
 }
 
+// cmdOutput runs the command and returns its stdout, its stderr being written redacted.
+func cmdOutput(cmd exec.Cmd) ([]byte, error) {
+	stderr := newRedactingWriter(os.Stderr)
+	cmd.SetStderr(stderr)
+	defer stderr.Flush()
+	return exec.Output(cmd)
+}
+
+// runCmd runs the command with its output redacted.
 func runCmd(cmd exec.Cmd) error {
-	exec.InheritOutput(cmd)
+	stdout, stderr := newRedactingWriter(os.Stdout), newRedactingWriter(os.Stderr)
+	cmd.SetStdout(stdout)
+	cmd.SetStderr(stderr)
+	defer stdout.Flush()
+	defer stderr.Flush()
 	return cmd.Run()
 }
 
+// resourceGroupExists returns true if the resource group exists.
+func (d *deployer) resourceGroupExists(subscriptionID string, credential azcore.TokenCredential) (bool, error) {
+	rgClient, err := armresources.NewResourceGroupsClient(subscriptionID, credential, d.armClientOptions())
+	if err != nil {
+		return false, fmt.Errorf("failed to new resource group client with sub ID %q: %v", subscriptionID, err)
+	}
+	resp, err := rgClient.CheckExistence(d.ctx, d.ResourceGroupName, nil)
+	if err != nil {
+		return false, err
+	}
+	return resp.Success, nil
+}
+
 // Define the function to create a resource group.
 func (d *deployer) createResourceGroup(subscriptionID string, credential azcore.TokenCredential) (armresources.ResourceGroupsClientCreateOrUpdateResponse, error) {
-	rgClient, _ := armresources.NewResourceGroupsClient(subscriptionID, credential, nil)
+	rgClient, _ := armresources.NewResourceGroupsClient(subscriptionID, credential, d.armClientOptions())
 
 	param := armresources.ResourceGroup{
 		Location: to.StringPtr(d.Location),
 	}
 
-	return rgClient.CreateOrUpdate(ctx, d.ResourceGroupName, param, nil)
+	return rgClient.CreateOrUpdate(d.ctx, d.ResourceGroupName, param, nil)
+}
+
+func cloudControllerManagerImage(imageTag string) string {
+	return fmt.Sprintf("%s/azure-cloud-controller-manager:%s", imageRegistry, imageTag)
+}
+
+func cloudNodeManagerImage(imageTag string) string {
+	return fmt.Sprintf("%s/azure-cloud-node-manager:%s-linux-amd64", imageRegistry, imageTag)
 }
 
 // prepareClusterConfig generates cluster config.
@@ -85,12 +158,18 @@ func (d *deployer) prepareClusterConfig(imageTag string, clusterID string) (stri
 	}
 	clusterConfig := string(configFile)
 	clusterConfigMap := map[string]string{
-		"{AKS_CLUSTER_ID}":      clusterID,
-		"{CLUSTER_NAME}":        d.ClusterName,
-		"{AZURE_LOCATION}":      d.Location,
-		"{AZURE_CLIENT_ID}":     clientID,
-		"{AZURE_CLIENT_SECRET}": clientSecret,
-		"{KUBERNETES_VERSION}":  d.K8sVersion,
+		"{AKS_CLUSTER_ID}":     clusterID,
+		"{CLUSTER_NAME}":       d.ClusterName,
+		"{AZURE_LOCATION}":     d.Location,
+		"{KUBERNETES_VERSION}": d.K8sVersion,
+	}
+	// Managed identity clusters drop servicePrincipalProfile, so the secret is never put in the payload.
+	if d.IdentityType == identityTypeServicePrincipal {
+		clusterConfigMap["{AZURE_CLIENT_ID}"] = clientID
+		clusterConfigMap["{AZURE_CLIENT_SECRET}"] = clientSecret
+	}
+	for k, v := range d.subnetIDPlaceholders() {
+		clusterConfigMap[k] = v
 	}
 	for k, v := range clusterConfigMap {
 		clusterConfig = strings.ReplaceAll(clusterConfig, k, v)
@@ -102,8 +181,8 @@ func (d *deployer) prepareClusterConfig(imageTag string, clusterID string) (stri
 	}
 
 	cloudProviderImageMap := map[string]string{
-		"{CUSTOM_CCM_IMAGE}": fmt.Sprintf("%s/azure-cloud-controller-manager:%s", imageRegistry, imageTag),
-		"{CUSTOM_CNM_IMAGE}": fmt.Sprintf("%s/azure-cloud-node-manager:%s-linux-amd64", imageRegistry, imageTag),
+		"{CUSTOM_CCM_IMAGE}": cloudControllerManagerImage(imageTag),
+		"{CUSTOM_CNM_IMAGE}": cloudNodeManagerImage(imageTag),
 	}
 	for k, v := range cloudProviderImageMap {
 		customConfig = bytes.ReplaceAll(customConfig, []byte(k), []byte(v))
@@ -118,6 +197,9 @@ func (d *deployer) prepareClusterConfig(imageTag string, clusterID string) (stri
 }
 
 func (d *deployer) getAzureClientConfig() (*azclients.ClientConfig, error) {
+	if err := d.resolveClientSecret(); err != nil {
+		return nil, err
+	}
 	oauthConfig, err := adal.NewOAuthConfigWithAPIVersion(azure.PublicCloud.ActiveDirectoryEndpoint, tenantID, &apiVersion)
 	if err != nil {
 		return nil, fmt.Errorf("failed to new oath config with api version: %v", err)
@@ -135,24 +217,58 @@ func (d *deployer) getAzureClientConfig() (*azclients.ClientConfig, error) {
 		SubscriptionID:          subscriptionID,
 		ResourceManagerEndpoint: baseURL,
 		Authorizer:              authorizer,
-		Backoff:                 &retry.Backoff{Steps: 1},
+		// Requests are retried by the classified retry decorator of newArmClientWithAPIVersion.
+		Backoff: &retry.Backoff{Steps: 1},
 	}
 	return &azClientConfig, nil
 }
 
 func (d *deployer) newArmClient() (*armclient.Client, error) {
+	return d.newArmClientWithAPIVersion(apiVersion)
+}
+
+// newArmClientWithAPIVersion creates an ARM client for resources served by another API version.
+func (d *deployer) newArmClientWithAPIVersion(apiVersion string) (*armclient.Client, error) {
 	config, err := d.getAzureClientConfig()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get Azure client config: %v", err)
 	}
 
-	return armclient.New(config.Authorizer, *config, config.ResourceManagerEndpoint, apiVersion), nil
+	return armclient.New(config.Authorizer, *config, config.ResourceManagerEndpoint, apiVersion, d.withARMRecording(), d.withARMRetry()), nil
+}
+
+// putResource puts a resource with the API version and decodes the response into result if it is not nil.
+func (d *deployer) putResource(apiVersion, resourceID string, resource interface{}, result interface{}) error {
+	armClient, err := d.newArmClientWithAPIVersion(apiVersion)
+	if err != nil {
+		return fmt.Errorf("failed to new arm client: %v", err)
+	}
+
+	if err := d.recordIfNew(apiVersion, resourceID); err != nil {
+		return fmt.Errorf("failed to record resource %q: %v", resourceID, err)
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+
+	resp, rerr := armClient.PutResource(ctx, resourceID, resource)
+	defer armClient.CloseResponse(ctx, resp)
+	if rerr != nil {
+		return fmt.Errorf("failed to put resource %q: %v", resourceID, rerr.Error())
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode resource %q: %v", resourceID, err)
+	}
+	return nil
 }
 
 // createAKSWithCustomConfig creates an AKS cluster with custom configuration.
 func (d *deployer) createAKSWithCustomConfig(token string, imageTag string) error {
 	klog.Infof("Creating the AKS cluster with custom config")
-	clusterID := fmt.Sprintf("/subscriptions/%s/resourcegroups/%s/providers/Microsoft.ContainerService/managedClusters/%s", subscriptionID, d.ResourceGroupName, d.ClusterName)
+	clusterID := d.clusterResourceID()
 
 	clusterConfig, err := d.prepareClusterConfig(imageTag, clusterID)
 	if err != nil {
@@ -165,42 +281,101 @@ func (d *deployer) createAKSWithCustomConfig(token string, imageTag string) erro
 		autorest.WithHeader("AKSHTTPCustomFeatures", "Microsoft.ContainerService/EnableCloudControllerManager"),
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(d.ctx)
 	defer cancel()
 
 	var unmarshalledClusterConfig interface{}
 	if err := json.Unmarshal([]byte(clusterConfig), &unmarshalledClusterConfig); err != nil {
 		return fmt.Errorf("failed to unmarshal cluster config: %v", err)
 	}
+	if err := d.injectSubnetIDs(unmarshalledClusterConfig); err != nil {
+		return fmt.Errorf("failed to inject subnet IDs: %v", err)
+	}
+	if err := d.applyClusterIdentity(unmarshalledClusterConfig); err != nil {
+		return fmt.Errorf("failed to apply cluster identity: %v", err)
+	}
+	if err := d.applyPrivateCluster(unmarshalledClusterConfig); err != nil {
+		return fmt.Errorf("failed to apply private cluster: %v", err)
+	}
+	if err := tagCustomConfigHash(unmarshalledClusterConfig); err != nil {
+		return fmt.Errorf("failed to tag custom configuration hash: %v", err)
+	}
+	runID, err := d.clusterRunID()
+	if err != nil {
+		return fmt.Errorf("failed to get run ID: %v", err)
+	}
+	if err := tagRunID(unmarshalledClusterConfig, runID); err != nil {
+		return fmt.Errorf("failed to tag run ID: %v", err)
+	}
+	ccmName, err := ccmClusterName(unmarshalledClusterConfig)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster name of the cloud provider: %v", err)
+	}
+	if err := d.updateClusterState(func(cluster *clusterState) {
+		cluster.CCMClusterName = ccmName
+	}); err != nil {
+		return fmt.Errorf("failed to update state: %v", err)
+	}
+
+	// A creation in flight is resumed rather than checked
+	op, err := d.getPendingOperation(operationCreateCluster, clusterID)
+	if err != nil {
+		return err
+	}
+	if d.ReuseCluster && op == nil {
+		reusable, err := d.reusableCluster(clusterID, unmarshalledClusterConfig)
+		if err != nil {
+			return fmt.Errorf("failed to reuse cluster %q: %v", d.ClusterName, err)
+		}
+		if reusable {
+			klog.Infof("Reusing the AKS cluster %q in resource group %q which matches the template", d.ClusterName, d.ResourceGroupName)
+			return nil
+		}
+	}
 
 	armClient, err := d.newArmClient()
 	if err != nil {
 		return fmt.Errorf("failed to new arm client: %v", err)
 	}
-	resp, rerr := armClient.PutResource(ctx, clusterID, unmarshalledClusterConfig, decorators...)
+	if err := d.recordIfNew(apiVersion, clusterID); err != nil {
+		return fmt.Errorf("failed to record cluster %q: %v", clusterID, err)
+	}
+	// A creation started by a previous invocation is resumed
+	resp, err := d.putResourceResumable(armClient, operationCreateCluster, clusterID, func() (*azure.Future, *retry.Error) {
+		return armClient.PutResourceAsync(ctx, clusterID, unmarshalledClusterConfig, decorators...)
+	})
 	defer armClient.CloseResponse(ctx, resp)
-	if rerr != nil {
-		return fmt.Errorf("failed to put resource: %v", rerr.Error())
+	if err != nil {
+		return fmt.Errorf("failed to put resource: %v", err)
 	}
 
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("failed to create the AKS cluster: output %v\nerr %v", resp, err)
+		return fmt.Errorf("failed to create the AKS cluster: status %d, correlation ID %q, see %s: %s",
+			resp.StatusCode, resp.Header.Get("x-ms-correlation-request-id"), armTrafficPath(), redactBody(readResponseBody(resp)))
 	}
 	klog.Infof("An AKS cluster %q in resource group %q is created", d.ClusterName, d.ResourceGroupName)
 	return nil
 }
 
+func (d *deployer) clusterResourceID() string {
+	return fmt.Sprintf("/subscriptions/%s/resourcegroups/%s/providers/Microsoft.ContainerService/managedClusters/%s", subscriptionID, d.ResourceGroupName, d.ClusterName)
+}
+
+func (d *deployer) clusterKubeconfigPath() string {
+	return fmt.Sprintf("%s/%s_%s.kubeconfig", defaultKubeconfigDir, d.ResourceGroupName, d.ClusterName)
+}
+
 // getAKSKubeconfig gets kubeconfig of the AKS cluster and writes it to specific path.
 func (d *deployer) getAKSKubeconfig(cred *azidentity.DefaultAzureCredential) error {
 	klog.Infof("Retrieving AKS cluster's kubeconfig")
-	client, err := armcontainerservicev2.NewManagedClustersClient(subscriptionID, cred, nil)
+	client, err := armcontainerservicev2.NewManagedClustersClient(subscriptionID, cred, d.armClientOptions())
 	if err != nil {
 		return fmt.Errorf("failed to new managed cluster client with sub ID %q: %v", subscriptionID, err)
 	}
 
 	var resp armcontainerservicev2.ManagedClustersClientListClusterUserCredentialsResponse
-	err = wait.PollImmediate(10*time.Second, 3*time.Minute, func() (done bool, err error) {
-		resp, err = client.ListClusterUserCredentials(ctx, d.ResourceGroupName, d.ClusterName, nil)
+	err = wait.PollImmediateWithContext(d.ctx, 10*time.Second, 3*time.Minute, func(ctx context.Context) (done bool, err error) {
+		resp, err = client.ListClusterUserCredentials(d.ctx, d.ResourceGroupName, d.ClusterName, nil)
 		if err != nil {
 			if strings.Contains(err.Error(), "404 Not Found") {
 				klog.Infof("failed to list cluster user credentials for 10 second, retrying")
@@ -219,12 +394,12 @@ func (d *deployer) getAKSKubeconfig(cred *azidentity.DefaultAzureCredential) err
 		return fmt.Errorf("failed to find a valid kubeconfig")
 	}
 	kubeconfig := kubeconfigs[0]
-	destPath := fmt.Sprintf("%s/%s_%s.kubeconfig", defaultKubeconfigDir, d.ResourceGroupName, d.ClusterName)
+	destPath := d.clusterKubeconfigPath()
 
 	if err := os.MkdirAll(defaultKubeconfigDir, os.ModePerm); err != nil {
 		return fmt.Errorf("failed to mkdir the default kubeconfig dir: %v", err)
 	}
-	if err := ioutil.WriteFile(destPath, kubeconfig.Value, 0666); err != nil {
+	if err := writePrivateFile(destPath, kubeconfig.Value); err != nil {
 		return fmt.Errorf("failed to write kubeconfig to %s", destPath)
 	}
 
@@ -232,6 +407,14 @@ func (d *deployer) getAKSKubeconfig(cred *azidentity.DefaultAzureCredential) err
 	return nil
 }
 
+// defaultClusterName names the cluster when --clusterName is not set, for Down and
+// DumpClusterLogs as well as Up.
+func (d *deployer) defaultClusterName() {
+	if d.ClusterName == "" {
+		d.ClusterName = defaultClusterName
+	}
+}
+
 func (d *deployer) verifyUpFlags() error {
 	if d.ResourceGroupName == "" {
 		return fmt.Errorf("resource group name is empty")
@@ -239,11 +422,9 @@ func (d *deployer) verifyUpFlags() error {
 	if d.Location == "" {
 		return fmt.Errorf("location is empty")
 	}
-	if d.ClusterName == "" {
-		d.ClusterName = "aks-cluster"
-	}
-	if d.ConfigPath == "" {
-		return fmt.Errorf("cluster config path is empty")
+	d.defaultClusterName()
+	if d.Adopt {
+		return d.verifyAdoptFlags()
 	}
 	if d.CustomConfigPath == "" {
 		return fmt.Errorf("custom config path is empty")
@@ -251,61 +432,330 @@ func (d *deployer) verifyUpFlags() error {
 	if d.CCMImageTag == "" {
 		return fmt.Errorf("ccm image tag is empty")
 	}
-	if d.K8sVersion == "" {
-		return fmt.Errorf("k8s version is empty")
+	specs, err := d.getClusterSpecs()
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if spec.ConfigPath == "" {
+			return fmt.Errorf("cluster config path of cluster %q is empty", spec.Name)
+		}
+		if spec.K8sVersion == "" {
+			return fmt.Errorf("k8s version of cluster %q is empty", spec.Name)
+		}
+	}
+	if err := d.verifyIdentityFlags(); err != nil {
+		return err
+	}
+	if err := d.verifyPrivateFlags(); err != nil {
+		return err
+	}
+	if err := d.verifyPostUpFlags(); err != nil {
+		return err
+	}
+	if err := d.verifyControlPlaneLogsFlags(); err != nil {
+		return err
+	}
+	if d.ReadinessTimeout == 0 {
+		d.ReadinessTimeout = defaultReadinessTimeout
 	}
 	return nil
 }
 
 func (d *deployer) Up() error {
+	d, cancel := d.withPhaseContext("Up", d.UpTimeout, true)
+	defer cancel()
+	err := d.phaseError(d.up(), d.UpTimeout)
+	d.writePhaseResults(err)
+	return err
+}
+
+func (d *deployer) up() error {
+	// Like Down, dumping the network of existing clusters needs no template
+	if d.DumpNetworkOnly {
+		return d.dumpNetworkOnly()
+	}
 	if err := d.verifyUpFlags(); err != nil {
 		return fmt.Errorf("up flags are invalid: %v", err)
 	}
 
 	// Create a credential object.
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	cred, err := d.newCredential()
 	if err != nil {
-		klog.Fatalf("Authentication failure: %+v", err)
+		return fmt.Errorf("authentication failure: %v", err)
+	}
+
+	if d.Adopt {
+		return d.step("adopt clusters", func() error {
+			return d.adoptClusters(cred)
+		})
+	}
+
+	if !d.SkipPreflight {
+		clusters, err := d.clusters()
+		if err != nil {
+			return err
+		}
+		if err := d.step("preflight", func() error {
+			return d.preflight(cred, clusters)
+		}); err != nil {
+			return err
+		}
+	}
+	if d.PreflightOnly {
+		return nil
+	}
+
+	locations := d.upLocations()
+	for i, location := range locations {
+		d.Location = location
+		err = d.upInLocation(cred)
+		if err == nil || i == len(locations)-1 || !classifyARMError(err).locationBound() {
+			break
+		}
+		klog.Warningf("Capacity or quota is insufficient in location %q, falling back to %q: %v", location, locations[i+1], err)
+		if err := d.step("clean up for fallback", func() error {
+			return d.cleanUpForFallback(cred)
+		}); err != nil {
+			return fmt.Errorf("failed to clean up location %q for fallback: %v", location, err)
+		}
+	}
+	if err != nil && d.CleanupOnFailure {
+		if d.interrupted() {
+			// kubetest2 calls Down on interruption
+			klog.Infof("Up is interrupted, leaving the clean-up to Down")
+		} else {
+			_ = d.step("clean up on failure", func() error {
+				d.cleanUpOnFailure(cred)
+				return nil
+			})
+		}
+	}
+	return err
+}
+
+// upInLocation creates the resource group and the clusters in d.Location.
+// Clusters without a location of their own in --clusters are created there.
+func (d *deployer) upInLocation(cred *azidentity.DefaultAzureCredential) error {
+	clusters, err := d.clusters()
+	if err != nil {
+		return err
+	}
+	for _, c := range clusters {
+		// Resolve the Kubernetes version against what the location offers
+		if err := c.clusterStep("resolve Kubernetes version", c.resolveKubernetesVersion); err != nil {
+			return fmt.Errorf("failed to resolve Kubernetes version of cluster %q: %v", c.ClusterName, err)
+		}
+	}
+
+	// A deletion of the resource group in flight would fail the creation
+	if op, err := d.getPendingOperation(operationDeleteResourceGroup, d.ResourceGroupName); err != nil {
+		return err
+	} else if op != nil {
+		if err := d.deleteResourceGroup(subscriptionID, cred, false); err != nil {
+			return fmt.Errorf("failed to wait on the pending deletion of the resource group: %v", err)
+		}
 	}
 
 	// Create the resource group
-	resourceGroup, err := d.createResourceGroup(subscriptionID, cred)
+	var exists bool
+	if err := d.step("create resource group", func() error {
+		var err error
+		exists, err = d.resourceGroupExists(subscriptionID, cred)
+		if err != nil {
+			return fmt.Errorf("failed to check existence of the resource group: %v", err)
+		}
+		// The location of a resource group cannot change, but it holds resources of
+		// any location, like those of a fallback location
+		if exists {
+			klog.Infof("Resource group %q exists, creating resources in location %q in it", d.ResourceGroupName, d.Location)
+			return nil
+		}
+		resourceGroup, err := d.createResourceGroup(subscriptionID, cred)
+		if err != nil {
+			return fmt.Errorf("failed to create the resource group: %v", err)
+		}
+		klog.Infof("Resource group %s created", *resourceGroup.ResourceGroup.ID)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := d.updateState(func(state *runState) {
+		state.ResourceGroupName = d.ResourceGroupName
+		state.Location = d.Location
+		state.ResourceGroupCreated = state.ResourceGroupCreated || !exists
+		state.Adopted = false
+		state.AttemptedLocations = append(state.AttemptedLocations, d.Location)
+	}); err != nil {
+		return fmt.Errorf("failed to update state: %v", err)
+	}
+
+	// Create the customer virtual network
+	spec, err := d.getNetworkSpec()
 	if err != nil {
-		return fmt.Errorf("failed to create the resource group: %v", err)
+		return fmt.Errorf("failed to get network spec: %v", err)
+	}
+	if spec != nil {
+		if err := d.step("create virtual network", func() error {
+			return d.createVirtualNetwork(spec)
+		}); err != nil {
+			return fmt.Errorf("failed to create the virtual network: %v", err)
+		}
+	}
+
+	// Create the custom role definition once, since the clusters share its ID
+	if d.IdentityType == identityTypeUserAssigned && d.RoleDefinitionPath != "" {
+		if err := d.step("create custom role definition", func() error {
+			var err error
+			d.customRoleDefinitionID, err = d.createCustomRoleDefinition()
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to create custom role definition: %v", err)
+		}
 	}
-	klog.Infof("Resource group %s created", *resourceGroup.ResourceGroup.ID)
 
-	token, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{"https://management.azure.com/.default"}})
+	// Create the control-plane logs destinations once, since clusters in a location share one
+	if d.ControlPlaneLogs != "" {
+		if err := d.step("create control-plane logs destinations", func() error {
+			return d.createControlPlaneLogsDestinations(clusters)
+		}); err != nil {
+			return fmt.Errorf("failed to create control-plane logs destinations: %v", err)
+		}
+	}
+
+	// Create the clusters concurrently
+	if err := forEachCluster(clusters, func(c *deployer) error {
+		// The copies were made before the virtual network and the role definition were created
+		c.networkSpec, c.subnetIDs = d.networkSpec, d.subnetIDs
+		c.customRoleDefinitionID = d.customRoleDefinitionID
+		return c.upCluster(cred)
+	}); err != nil {
+		return err
+	}
+
+	if err := d.step("merge kubeconfigs", func() error {
+		return d.mergeKubeconfigs(clusters)
+	}); err != nil {
+		return fmt.Errorf("failed to merge kubeconfigs: %v", err)
+	}
+	d.recordHourlyCost(cred, clusters)
+
+	// Snapshotting is diagnostics, it never fails Up
+	if d.SnapshotResources || d.FailOnLeakedResources {
+		if err := d.step("snapshot resources", d.snapshotResourcesAfterUp); err != nil {
+			klog.Warningf("failed to snapshot resources: %v", err)
+		}
+	}
+	return nil
+}
+
+// upCluster creates one AKS cluster of the run in the resource group.
+func (d *deployer) upCluster(cred *azidentity.DefaultAzureCredential) error {
+	// Create the cluster identities
+	if err := d.clusterStep("create identities", d.createClusterIdentities); err != nil {
+		return fmt.Errorf("failed to create cluster identities: %v", err)
+	}
+
+	token, err := cred.GetToken(d.ctx, policy.TokenRequestOptions{Scopes: []string{"https://management.azure.com/.default"}})
 	if err != nil {
 		return fmt.Errorf("failed to get token from credential: %v", err)
 	}
 
 	// Create the AKS cluster
-	if err := d.createAKSWithCustomConfig(token.Token, d.CCMImageTag); err != nil {
+	if err := d.clusterStep("create cluster", func() error {
+		return d.createAKSWithCustomConfig(token.Token, d.CCMImageTag)
+	}); err != nil {
 		return fmt.Errorf("failed to create the AKS cluster: %v", err)
 	}
 
 	// Get the cluster kubeconfig
-	if err := d.getAKSKubeconfig(cred); err != nil {
+	if err := d.clusterStep("get kubeconfig", func() error {
+		return d.getAKSKubeconfig(cred)
+	}); err != nil {
 		return fmt.Errorf("failed to get AKS cluster kubeconfig: %v", err)
 	}
+
+	if err := d.updateClusterState(func(cluster *clusterState) {
+		cluster.Location = d.Location
+		cluster.K8sVersion = d.K8sVersion
+		cluster.Kubeconfig = d.clusterKubeconfigPath()
+		// A reused cluster keeps running since the first Up
+		if cluster.UpAt.IsZero() {
+			cluster.UpAt = d.phaseStart
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to update state: %v", err)
+	}
+
+	// Send the control-plane logs to a storage account or a Log Analytics workspace
+	if err := d.clusterStep("enable control-plane logs", d.enableControlPlaneLogs); err != nil {
+		return fmt.Errorf("failed to enable control-plane logs: %v", err)
+	}
+
+	// Provision and document the path to the API server
+	if err := d.clusterStep("set up API server access", func() error {
+		return d.setupAPIServerAccess(cred)
+	}); err != nil {
+		return fmt.Errorf("failed to set up API server access: %v", err)
+	}
+
+	// Wait for the nodes and the custom cloud provider
+	if err := d.clusterStep("wait for readiness", func() error {
+		return d.waitForClusterReadiness(cred)
+	}); err != nil {
+		return err
+	}
+
+	// Install the post-Up manifests and helm charts
+	if err := d.clusterStep("install post-Up manifests and helm charts", d.installPostUp); err != nil {
+		return fmt.Errorf("failed to install post-Up manifests and helm charts: %v", err)
+	}
 	return nil
 }
 
 func (d *deployer) IsUp() (up bool, err error) {
-	config, err := d.getAzureClientConfig()
+	d, cancel := d.withPhaseContext("IsUp", 0, true)
+	defer cancel()
+
+	d.defaultClusterName()
+	clusters, err := d.clusters()
+	if err != nil {
+		return false, err
+	}
+	for _, c := range clusters {
+		up, err := c.isClusterUp()
+		if err != nil || !up {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// isClusterUp returns true if the cluster is provisioned successfully.
+func (d *deployer) isClusterUp() (up bool, err error) {
+	cred, err := d.newCredential()
 	if err != nil {
-		return false, fmt.Errorf("failed to get client config: %v", err)
+		return false, fmt.Errorf("failed to obtain a credential: %v", err)
+	}
+	client, err := armcontainerservicev2.NewManagedClustersClient(subscriptionID, cred, d.armClientOptions())
+	if err != nil {
+		return false, fmt.Errorf("failed to new managed cluster client with sub ID %q: %v", subscriptionID, err)
 	}
-	client := containerserviceclient.New(config)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// A creation in flight is not waited on, it may take longer than the caller
+	op, err := d.getPendingOperation(operationCreateCluster, d.clusterResourceID())
+	if err != nil {
+		return false, err
+	}
+	if op != nil {
+		klog.Infof("Cluster %q is not up: its creation started at %s is pending", d.ClusterName, op.StartedAt.Format(time.RFC3339))
+		return false, nil
+	}
 
-	managedCluster, rerr := client.Get(ctx, d.ResourceGroupName, d.ClusterName)
-	if rerr != nil {
-		return false, fmt.Errorf("failed to get managed cluster %q in resource group %q: %v", d.ClusterName, d.ResourceGroupName, rerr.Error())
+	managedCluster, err := client.Get(d.ctx, d.ResourceGroupName, d.ClusterName, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to get managed cluster %q in resource group %q: %v", d.ClusterName, d.ResourceGroupName, err)
 	}
 
-	return managedCluster.ProvisioningState != nil && *managedCluster.ProvisioningState == "Succeeded", nil
+	return managedCluster.Properties != nil && to.String(managedCluster.Properties.ProvisioningState) == "Succeeded", nil
 }
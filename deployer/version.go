@@ -0,0 +1,202 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/klog"
+)
+
+var (
+	orchestratorsAPIVersion = "2019-08-01"
+)
+
+type orchestratorVersionProfile struct {
+	OrchestratorType    string `json:"orchestratorType"`
+	OrchestratorVersion string `json:"orchestratorVersion"`
+	Default             *bool  `json:"default,omitempty"`
+	IsPreview           *bool  `json:"isPreview,omitempty"`
+}
+
+type orchestratorVersionProfileList struct {
+	Properties struct {
+		Orchestrators []orchestratorVersionProfile `json:"orchestrators"`
+	} `json:"properties"`
+}
+
+// listKubernetesVersions lists Kubernetes versions AKS offers in the location.
+func (d *deployer) listKubernetesVersions() ([]orchestratorVersionProfile, error) {
+	armClient, err := d.newArmClientWithAPIVersion(orchestratorsAPIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new arm client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+
+	resourceID := fmt.Sprintf("/subscriptions/%s/providers/Microsoft.ContainerService/locations/%s/orchestrators", subscriptionID, d.Location)
+	resp, rerr := armClient.GetResource(ctx, resourceID, autorest.WithQueryParameters(map[string]interface{}{"resource-type": "managedClusters"}))
+	defer armClient.CloseResponse(ctx, resp)
+	if rerr != nil {
+		return nil, fmt.Errorf("failed to list orchestrators in location %q: %v", d.Location, rerr.Error())
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read orchestrators response: %v", err)
+	}
+	var list orchestratorVersionProfileList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal orchestrators response: %v", err)
+	}
+
+	var profiles []orchestratorVersionProfile
+	for _, p := range list.Properties.Orchestrators {
+		if strings.EqualFold(p.OrchestratorType, "Kubernetes") {
+			profiles = append(profiles, p)
+		}
+	}
+	return profiles, nil
+}
+
+// resolveK8sVersion resolves an alias such as "latest", "default", "1.27" or "n-1"
+// into an exact Kubernetes version offered by AKS in the location.
+func resolveK8sVersion(alias string, profiles []orchestratorVersionProfile, includePreview bool) (string, error) {
+	var versions []*version.Version
+	var defaultVersion string
+	for _, p := range profiles {
+		if p.IsPreview != nil && *p.IsPreview && !includePreview {
+			continue
+		}
+		v, err := version.ParseGeneric(p.OrchestratorVersion)
+		if err != nil {
+			klog.Warningf("Skipping unparsable Kubernetes version %q: %v", p.OrchestratorVersion, err)
+			continue
+		}
+		versions = append(versions, v)
+		if p.Default != nil && *p.Default {
+			defaultVersion = p.OrchestratorVersion
+		}
+	}
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no Kubernetes version is available")
+	}
+	// Newest first
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[j].LessThan(versions[i])
+	})
+
+	alias = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(alias)), "v")
+	switch {
+	case alias == "latest":
+		return versions[0].String(), nil
+	case alias == "default":
+		if defaultVersion == "" {
+			return "", fmt.Errorf("no default Kubernetes version is available")
+		}
+		return defaultVersion, nil
+	case strings.HasPrefix(alias, "n-"):
+		offset, err := strconv.Atoi(strings.TrimPrefix(alias, "n-"))
+		if err != nil || offset < 0 {
+			return "", fmt.Errorf("invalid Kubernetes version alias %q", alias)
+		}
+		// Walk down the distinct major and minor versions, newest first
+		current := versions[0]
+		for _, v := range versions {
+			if sameMinor(v, current) {
+				continue
+			}
+			if offset == 0 {
+				break
+			}
+			current = v
+			offset--
+		}
+		if offset > 0 {
+			return "", fmt.Errorf("Kubernetes version alias %q is older than any available version", alias)
+		}
+		// The newest patch of the minor version
+		return current.String(), nil
+	}
+
+	requested, err := version.ParseGeneric(alias)
+	if err != nil {
+		return "", fmt.Errorf("invalid Kubernetes version %q: %v", alias, err)
+	}
+	exact := exactK8sVersion(alias)
+	for _, v := range versions {
+		if !sameMinor(v, requested) {
+			continue
+		}
+		if !exact || v.Patch() == requested.Patch() {
+			return v.String(), nil
+		}
+	}
+
+	available := make([]string, 0, len(versions))
+	for _, v := range versions {
+		available = append(available, v.String())
+	}
+	return "", fmt.Errorf("Kubernetes version %q is not available, available versions: %s", alias, strings.Join(available, ", "))
+}
+
+// exactK8sVersion returns true if the version is an exact <major>.<minor>.<patch>
+// version rather than an alias.
+func exactK8sVersion(v string) bool {
+	v = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), "v")
+	_, err := version.ParseGeneric(v)
+	return err == nil && len(strings.Split(v, ".")) > 2
+}
+
+// sameMinor returns true if the versions have the same major and minor versions.
+func sameMinor(a, b *version.Version) bool {
+	return a.Major() == b.Major() && a.Minor() == b.Minor()
+}
+
+// resolveKubernetesVersion replaces d.K8sVersion with the exact version it resolves to
+// in the location and records it in the run metadata.
+func (d *deployer) resolveKubernetesVersion() error {
+	profiles, err := d.listKubernetesVersions()
+	if err != nil {
+		return fmt.Errorf("failed to list Kubernetes versions: %v", err)
+	}
+
+	resolved, err := resolveK8sVersion(d.K8sVersion, profiles, d.K8sVersionPreview)
+	if err != nil {
+		return fmt.Errorf("failed to resolve Kubernetes version %q in location %q: %v", d.K8sVersion, d.Location, err)
+	}
+	klog.Infof("Kubernetes version %q resolved to %q in location %q", d.K8sVersion, resolved, d.Location)
+	d.requestedK8sVersion, d.K8sVersion = d.K8sVersion, resolved
+
+	key := "aks-kubernetes-version"
+	if d.ClusterSpecsPath != "" {
+		key = fmt.Sprintf("%s-%s", key, d.ClusterName)
+	}
+	if err := d.addRunMetadata(key, resolved); err != nil {
+		klog.Warningf("failed to record Kubernetes version in run metadata: %v", err)
+	}
+	return nil
+}
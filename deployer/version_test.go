@@ -0,0 +1,91 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployer
+
+import (
+	"testing"
+)
+
+func profiles(defaultVersion string, preview []string, versions ...string) []orchestratorVersionProfile {
+	var result []orchestratorVersionProfile
+	t, f := true, false
+	for _, v := range versions {
+		p := orchestratorVersionProfile{OrchestratorType: "Kubernetes", OrchestratorVersion: v, Default: &f, IsPreview: &f}
+		if v == defaultVersion {
+			p.Default = &t
+		}
+		for _, pv := range preview {
+			if v == pv {
+				p.IsPreview = &t
+			}
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+func TestResolveK8sVersion(t *testing.T) {
+	available := profiles("1.23.8", []string{"1.25.2"}, "1.22.6", "1.22.11", "1.23.5", "1.23.8", "1.24.3", "1.25.2")
+	crossMajor := profiles("", nil, "1.0.5", "1.1.2", "2.0.1", "2.1.0", "2.1.3")
+
+	testCases := []struct {
+		name           string
+		alias          string
+		profiles       []orchestratorVersionProfile
+		includePreview bool
+		expected       string
+		expectErr      bool
+	}{
+		{name: "latest skips preview", alias: "latest", profiles: available, expected: "1.24.3"},
+		{name: "latest with preview", alias: "latest", profiles: available, includePreview: true, expected: "1.25.2"},
+		{name: "default", alias: "default", profiles: available, expected: "1.23.8"},
+		{name: "no default", alias: "default", profiles: crossMajor, expectErr: true},
+		{name: "minor", alias: "1.22", profiles: available, expected: "1.22.11"},
+		{name: "v prefix", alias: "v1.23", profiles: available, expected: "1.23.8"},
+		{name: "exact", alias: "1.22.6", profiles: available, expected: "1.22.6"},
+		{name: "unavailable patch", alias: "1.22.7", profiles: available, expectErr: true},
+		{name: "unavailable minor", alias: "1.21", profiles: available, expectErr: true},
+		{name: "n-0", alias: "n-0", profiles: available, expected: "1.24.3"},
+		{name: "n-1", alias: "n-1", profiles: available, expected: "1.23.8"},
+		{name: "n-2", alias: "n-2", profiles: available, expected: "1.22.11"},
+		{name: "n-3 too old", alias: "n-3", profiles: available, expectErr: true},
+		{name: "invalid offset", alias: "n-x", profiles: available, expectErr: true},
+		{name: "n-1 across majors", alias: "n-1", profiles: crossMajor, expected: "2.0.1"},
+		{name: "n-2 across majors", alias: "n-2", profiles: crossMajor, expected: "1.1.2"},
+		{name: "n-3 across majors", alias: "n-3", profiles: crossMajor, expected: "1.0.5"},
+		{name: "minor of another major", alias: "1.1", profiles: crossMajor, expected: "1.1.2"},
+		{name: "no versions", alias: "latest", profiles: nil, expectErr: true},
+		{name: "invalid", alias: "newest", profiles: available, expectErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resolved, err := resolveK8sVersion(tc.alias, tc.profiles, tc.includePreview)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", resolved)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resolved != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, resolved)
+			}
+		})
+	}
+}